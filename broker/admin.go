@@ -0,0 +1,436 @@
+/*
+Operator controls for the broker, authenticated with a bearer token, a client
+certificate on a separate admin listener, or both.
+*/
+
+package broker
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Implements the http.Handler interface, passing on only requests that carry
+// the admin token, if one is set, in an "Authorization: Bearer" header.
+type AdminHandler struct {
+	*BrokerContext
+	handle func(*BrokerContext, http.ResponseWriter, *http.Request)
+}
+
+func (ah AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ah.reloadLock.RLock()
+	adminToken := ah.adminToken
+	ah.reloadLock.RUnlock()
+	expected := []byte("Bearer " + adminToken)
+	got := []byte(r.Header.Get("Authorization"))
+	if adminToken != "" && subtle.ConstantTimeCompare(got, expected) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ah.handle(ah.BrokerContext, w, r)
+}
+
+// Implements the http.Handler interface, passing on only requests made with a
+// TLS client certificate issued by one of roots. The server must request
+// client certificates without verifying them, with tls.RequestClientCert, so
+// that they are checked here and a bad one gets a 403 rather than a failed
+// handshake.
+type ClientCertHandler struct {
+	handler http.Handler
+	roots   *x509.CertPool
+}
+
+func NewClientCertHandler(handler http.Handler, roots *x509.CertPool) *ClientCertHandler {
+	return &ClientCertHandler{handler: handler, roots: roots}
+}
+
+func (ch *ClientCertHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	opts := x509.VerifyOptions{
+		Roots:         ch.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := r.TLS.PeerCertificates[0].Verify(opts); err != nil {
+		log.Printf("Admin: rejected client certificate: %v", err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ch.handler.ServeHTTP(w, r)
+}
+
+// Reads a file of PEM-encoded CA certificates.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", filename)
+	}
+	return pool, nil
+}
+
+// Reports whether the broker is draining, in which case it no longer accepts
+// proxy polls but still matches clients with the proxies it already has.
+func (ctx *BrokerContext) Draining() bool {
+	return atomic.LoadInt32(&ctx.draining) != 0
+}
+
+func (ctx *BrokerContext) SetDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	if atomic.SwapInt32(&ctx.draining, value) != value {
+		log.Printf("Draining: %v", draining)
+	}
+	for _, pool := range ctx.vhostPools {
+		pool.SetDraining(draining)
+	}
+}
+
+func drainHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx.SetDraining(true)
+}
+
+func undrainHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx.SetDraining(false)
+}
+
+// Shown in place of the paths of secrets, such as token and key files, by
+// /admin/config.
+const redacted = "[redacted]"
+
+// The configuration in effect, as shown by /admin/config, with defaults
+// filled in and secrets redacted.
+type effectiveConfig struct {
+	// One of "acme", "certificate", or "disabled".
+	TLSMode          string   `json:"tls_mode"`
+	TLSMinVersion    string   `json:"tls_min_version,omitempty"`
+	AcmeHostnames    []string `json:"acme_hostnames,omitempty"`
+	KeyFilename      string   `json:"key_file,omitempty"`
+	EnableH2C        bool     `json:"h2c"`
+	AdminAddr        string   `json:"admin_addr,omitempty"`
+	AdminKeyFilename string   `json:"admin_key_file,omitempty"`
+	AdminTokenFile   string   `json:"admin_token_file,omitempty"`
+	MetricsAuth      string   `json:"metrics_auth,omitempty"`
+
+	Geoip                bool   `json:"geoip"`
+	GeoipDatabase        string `json:"geoip_database,omitempty"`
+	Geoip6Database       string `json:"geoip6_database,omitempty"`
+	GeoipRefreshURL      string `json:"geoip_refresh_url,omitempty"`
+	GeoipRefreshInterval string `json:"geoip_refresh_interval,omitempty"`
+	// May carry proxy credentials.
+	GeoipRefreshProxy string `json:"geoip_refresh_proxy,omitempty"`
+
+	ClientTimeout         string            `json:"client_timeout"`
+	ClientTimeoutByNAT    map[string]string `json:"client_timeout_by_nat,omitempty"`
+	MaxClientTimeout      string            `json:"max_client_timeout"`
+	ProxyTimeout          string            `json:"proxy_timeout"`
+	MaxProxyTimeout       string            `json:"max_proxy_timeout"`
+	AdaptiveTimeoutMin    string            `json:"min_adaptive_proxy_timeout"`
+	AdaptiveTimeoutMax    string            `json:"max_adaptive_proxy_timeout"`
+	MatchDeadline         string            `json:"match_deadline"`
+	ClientQueueWait       string            `json:"client_queue_wait"`
+	MaxOfferAge           string            `json:"max_offer_age"`
+	TimeoutJitter         float64           `json:"timeout_jitter"`
+	MaxProxyLifetime      string            `json:"max_proxy_lifetime"`
+	ProxyLifetimeCooldown string            `json:"proxy_lifetime_cooldown"`
+	QuarantineAfter       int               `json:"quarantine_after"`
+	QuarantineWindow      string            `json:"quarantine_window"`
+	QuarantineCooldown    string            `json:"quarantine_cooldown"`
+	ProxyStaleAfter       string            `json:"proxy_stale_after"`
+	ShedLatency           string            `json:"shed_latency"`
+	AuditInterval         string            `json:"audit_interval"`
+	AnswerDeliverTimeout  string            `json:"answer_deliver_timeout"`
+
+	MatchStrategy         string             `json:"match_strategy,omitempty"`
+	ProxyTypeWeights      map[string]float64 `json:"proxy_type_weights,omitempty"`
+	VhostPools            map[string]string  `json:"vhost_pools,omitempty"`
+	AllowedProxyTypes     []string           `json:"allowed_proxy_types,omitempty"`
+	AllowedProxyTypesFile string             `json:"allowed_proxy_types_file,omitempty"`
+	ProxyTiersFile        string             `json:"proxy_tiers_file,omitempty"`
+	ClientFanout          int                `json:"client_fanout"`
+	BrokerWorkers         int                `json:"broker_workers"`
+	MaxInflightClients    int                `json:"max_inflight_clients"`
+	MaxClientOffers       int                `json:"max_client_offers_per_minute"`
+	MaxTrackedProxies     int                `json:"max_tracked_proxies"`
+	MinProxies            int                `json:"min_proxies_before_serving"`
+	AnswerRetries         int                `json:"answer_retries"`
+	ChannelBuffer         int                `json:"channel_buffer"`
+	NATRedetectAfter      int                `json:"nat_redetect_after"`
+	RequireSDPFingerprint bool               `json:"require_sdp_fingerprint"`
+	QualityMatching       bool               `json:"quality_matching"`
+	RegionMatching        bool               `json:"region_matching"`
+	RestrictedFallback    bool               `json:"allow_restricted_fallback"`
+	ProxyRegions          []string           `json:"proxy_regions,omitempty"`
+	ICEServers            []string           `json:"ice_servers,omitempty"`
+	CORSOrigin            string             `json:"cors_origin"`
+	CORSMaxAge            string             `json:"cors_max_age"`
+	CORSAllowedOrigins    []string           `json:"cors_allowed_origins,omitempty"`
+	FallbackBrokerURL     string             `json:"fallback_broker_url,omitempty"`
+	ShadowBrokerURL       string             `json:"shadow_broker_url,omitempty"`
+	EnableDebugEndpoint   bool               `json:"debug_endpoint"`
+	DecoyPage             string             `json:"decoy_page,omitempty"`
+	BlocklistFile         string             `json:"blocklist_file,omitempty"`
+	EventLogFilename      string             `json:"event_log,omitempty"`
+	EventSampleRate       float64            `json:"event_sample_rate,omitempty"`
+	MetricsFormat         string             `json:"metrics_format,omitempty"`
+	UnsafeLogging         bool               `json:"unsafe_logging"`
+	LogLevel              string             `json:"log_level,omitempty"`
+}
+
+// Returns value, or redacted if it is set.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+// Returns the URL value with its userinfo and query, which may carry
+// credentials, redacted, or value redacted entirely if it does not parse.
+func redactURL(value string) string {
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return redacted
+	}
+	hasUserinfo := u.User != nil
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	s := u.String()
+	if hasUserinfo {
+		s = strings.Replace(s, "//", "//"+redacted+"@", 1)
+	}
+	return s
+}
+
+// Returns the configuration in effect for cfg, taking the timeouts and limits
+// from ctx, where Run has filled in their defaults.
+func newEffectiveConfig(cfg Config, ctx *BrokerContext) *effectiveConfig {
+	c := &effectiveConfig{
+		TLSMode:          "disabled",
+		TLSMinVersion:    cfg.TLSMinVersion,
+		AcmeHostnames:    cfg.AcmeHostnames,
+		KeyFilename:      redact(cfg.KeyFilename),
+		EnableH2C:        cfg.EnableH2C,
+		AdminAddr:        cfg.AdminAddr,
+		AdminKeyFilename: redact(cfg.AdminKeyFilename),
+		AdminTokenFile:   redact(cfg.AdminTokenFile),
+		MetricsAuth:      redact(cfg.MetricsAuth),
+
+		Geoip:             !cfg.DisableGeoip,
+		GeoipRefreshURL:   redactURL(cfg.GeoipRefreshURL),
+		GeoipRefreshProxy: redact(cfg.GeoipRefreshProxy),
+
+		ClientTimeout:         ctx.clientTimeout.String(),
+		MaxClientTimeout:      ctx.maxClientTimeout.String(),
+		MatchDeadline:         ctx.matchDeadline.String(),
+		ProxyTimeout:          ctx.proxyTimeout.String(),
+		MaxProxyTimeout:       ctx.maxProxyTimeout.String(),
+		AdaptiveTimeoutMin:    ctx.minAdaptiveProxyTimeout.String(),
+		AdaptiveTimeoutMax:    ctx.maxAdaptiveProxyTimeout.String(),
+		ClientQueueWait:       ctx.clientQueueWait.String(),
+		MaxOfferAge:           ctx.maxOfferAge.String(),
+		TimeoutJitter:         ctx.timeoutJitter,
+		MaxProxyLifetime:      ctx.proxyLifetimes.maxLifetime.String(),
+		ProxyLifetimeCooldown: ctx.proxyLifetimes.cooldown.String(),
+		QuarantineAfter:       ctx.proxyQuarantine.threshold,
+		QuarantineWindow:      ctx.proxyQuarantine.window.String(),
+		QuarantineCooldown:    ctx.proxyQuarantine.cooldown.String(),
+		ProxyStaleAfter:       ctx.proxyHeartbeats.staleAfter.String(),
+		ShedLatency:           ctx.shedLatency.String(),
+		AuditInterval:         cfg.AuditInterval.String(),
+		AnswerDeliverTimeout:  ctx.answerDeliverTimeout.String(),
+
+		MatchStrategy:         ctx.matchStrategy,
+		ProxyTypeWeights:      ctx.proxyTypeWeights,
+		AllowedProxyTypes:     cfg.AllowedProxyTypes,
+		AllowedProxyTypesFile: cfg.AllowedProxyTypesFile,
+		ProxyTiersFile:        redact(cfg.ProxyTiersFile),
+		ClientFanout:          ctx.clientFanout,
+		BrokerWorkers:         cap(ctx.matchWorkers),
+		MaxInflightClients:    cap(ctx.inflightClients),
+		MaxClientOffers:       ctx.clientIDs.limit,
+		MaxTrackedProxies:     ctx.maxTrackedProxies,
+		MinProxies:            ctx.minProxiesBeforeServing,
+		AnswerRetries:         ctx.answerRetries,
+		ChannelBuffer:         ctx.channelBuffer,
+		NATRedetectAfter:      ctx.natRedetection.threshold,
+		RequireSDPFingerprint: ctx.requireSDPFingerprint,
+		QualityMatching:       ctx.qualityMatching,
+		RegionMatching:        ctx.regionMatching,
+		RestrictedFallback:    ctx.allowRestrictedFallback,
+		ProxyRegions:          cfg.ProxyRegions,
+		ICEServers:            ctx.iceServers,
+		CORSOrigin:            ctx.corsOrigin,
+		CORSMaxAge:            ctx.corsMaxAge.String(),
+		CORSAllowedOrigins:    cfg.CORSAllowedOrigins,
+		FallbackBrokerURL:     ctx.fallbackBrokerURL,
+		ShadowBrokerURL:       redactURL(cfg.ShadowBrokerURL),
+		EnableDebugEndpoint:   cfg.EnableDebugEndpoint,
+		DecoyPage:             cfg.DecoyPage,
+		BlocklistFile:         cfg.BlocklistFile,
+		EventLogFilename:      cfg.EventLogFilename,
+		EventSampleRate:       cfg.EventSampleRate,
+		MetricsFormat:         cfg.MetricsFormat,
+		UnsafeLogging:         cfg.UnsafeLogging,
+		LogLevel:              cfg.LogLevel,
+	}
+	if len(cfg.AcmeHostnames) > 0 {
+		c.TLSMode = "acme"
+	} else if cfg.CertFilename != "" && cfg.KeyFilename != "" {
+		c.TLSMode = "certificate"
+	}
+	if c.Geoip {
+		c.GeoipDatabase = cfg.GeoipDatabase
+		c.Geoip6Database = cfg.Geoip6Database
+	}
+	if cfg.GeoipRefreshURL != "" {
+		c.GeoipRefreshInterval = cfg.GeoipRefreshInterval.String()
+	}
+	if cfg.EventLogFilename != "" && c.EventSampleRate == 0 {
+		c.EventSampleRate = 1
+	}
+	if vhostPools, err := parseVhostPools(cfg.VhostPools); err == nil && len(vhostPools) > 0 {
+		c.VhostPools = vhostPools
+	}
+	if len(ctx.clientTimeoutByNAT) > 0 {
+		c.ClientTimeoutByNAT = make(map[string]string)
+		for natType, timeout := range ctx.clientTimeoutByNAT {
+			c.ClientTimeoutByNAT[natType] = timeout.String()
+		}
+	}
+	return c
+}
+
+func configHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(ctx.config)
+	if err != nil {
+		log.Printf("Error encoding config: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		log.Printf("unable to write config with error: %v", err)
+	}
+}
+
+// Characters of a proxy's session id shown by /admin/heap, enough to tell the
+// entries apart without revealing the ids proxies answer with.
+const heapIDPrefixLength = 4
+
+// A snowflake waiting in a heap, as shown by /admin/heap.
+type heapEntry struct {
+	ID      string    `json:"id"`
+	Clients int       `json:"clients"`
+	NAT     string    `json:"nat"`
+	Type    string    `json:"type"`
+	Region  string    `json:"region,omitempty"`
+	Tier    string    `json:"tier,omitempty"`
+	Added   time.Time `json:"added"`
+}
+
+// The snowflakes of each heap, in the order clients would be matched with
+// them.
+type heapDump struct {
+	Unrestricted         []heapEntry `json:"unrestricted"`
+	Restricted           []heapEntry `json:"restricted"`
+	PriorityUnrestricted []heapEntry `json:"priority_unrestricted"`
+	PriorityRestricted   []heapEntry `json:"priority_restricted"`
+}
+
+// Returns the entries of the snowflakes in sh, sorted in the order the match
+// strategy takes them, by priority or by when they were added. The caller must
+// hold snowflakeLock.
+func (ctx *BrokerContext) dumpHeap(sh *SnowflakeHeap) []heapEntry {
+	snowflakes := make(SnowflakeHeap, sh.Len())
+	copy(snowflakes, *sh)
+	sort.Slice(snowflakes, func(i, j int) bool {
+		if ctx.matchStrategy == MatchRoundRobin {
+			return snowflakes[i].seq < snowflakes[j].seq
+		}
+		return snowflakes.Less(i, j)
+	})
+	entries := make([]heapEntry, len(snowflakes))
+	for i, snowflake := range snowflakes {
+		id := snowflake.id
+		if len(id) > heapIDPrefixLength {
+			id = id[:heapIDPrefixLength]
+		}
+		entries[i] = heapEntry{
+			ID:      id,
+			Clients: snowflake.clients,
+			NAT:     snowflake.natType,
+			Type:    snowflake.proxyType,
+			Region:  snowflake.region,
+			Tier:    snowflake.tier,
+			Added:   snowflake.added,
+		}
+	}
+	return entries
+}
+
+// Shows the snowflakes waiting in each heap in the order they would be
+// matched, for diagnosing why a client got the proxy it did.
+func heapHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx.snowflakeLock.Lock()
+	dump := heapDump{
+		Unrestricted:         ctx.dumpHeap(ctx.snowflakes),
+		Restricted:           ctx.dumpHeap(ctx.restrictedSnowflakes),
+		PriorityUnrestricted: ctx.dumpHeap(ctx.prioritySnowflakes),
+		PriorityRestricted:   ctx.dumpHeap(ctx.priorityRestrictedSnowflakes),
+	}
+	ctx.snowflakeLock.Unlock()
+	b, err := json.Marshal(dump)
+	if err != nil {
+		log.Printf("Error encoding heap: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		log.Printf("unable to write heap with error: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Periodic audit of the snowflake heaps against idToSnowflake, so that a path
+failing to keep them in step shows up in the metrics and is repaired, rather
+than leaking snowflakes or the goroutines waiting on them.
+*/
+
+package broker
+
+import (
+	"container/heap"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of inconsistency repaired by audit.
+const (
+	// A snowflake in a heap without an index giving its place there.
+	inconsistencyMisindexed = "misindexed"
+	// A snowflake in a heap that idToSnowflake does not map its id to.
+	inconsistencyUntracked = "untracked"
+	// A snowflake in idToSnowflake that claims a place in a heap it is not
+	// in. Snowflakes taken from the heap for a client have no place, and are
+	// consistent.
+	inconsistencyMissing = "missing_from_heap"
+)
+
+// Audits the heaps and idToSnowflake every interval, forever.
+func (ctx *BrokerContext) auditEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx.audit()
+	}
+}
+
+// Checks that every snowflake in a heap has its index and is in
+// idToSnowflake, and that every snowflake in idToSnowflake with an index is
+// in its heap there, repairing and counting any that are not. Snowflakes
+// removed in the repair answer their proxies' polls with no offer. Returns
+// the number of repairs.
+func (ctx *BrokerContext) audit() int {
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+
+	repaired := 0
+	repair := func(kind string) {
+		log.Printf("Audit: repairing %s snowflake.", kind)
+		ctx.metrics.promMetrics.InconsistencyRepairedTotal.With(prometheus.Labels{"kind": kind}).Inc()
+		repaired++
+	}
+	for _, snowflakeHeap := range []*SnowflakeHeap{
+		ctx.snowflakes, ctx.restrictedSnowflakes,
+		ctx.prioritySnowflakes, ctx.priorityRestrictedSnowflakes,
+	} {
+		misindexed := false
+		for i, snowflake := range *snowflakeHeap {
+			if snowflake.index != i {
+				repair(inconsistencyMisindexed)
+				snowflake.index = i
+				misindexed = true
+			}
+		}
+		// Whatever moved the snowflake may also have left it out of order.
+		if misindexed {
+			heap.Init(snowflakeHeap)
+		}
+		// Removing from the heap moves the others, so look again from the
+		// start after each removal.
+		for i := 0; i < snowflakeHeap.Len(); i++ {
+			snowflake := (*snowflakeHeap)[i]
+			if ctx.idToSnowflake[snowflake.id] == snowflake {
+				continue
+			}
+			repair(inconsistencyUntracked)
+			heap.Remove(snowflakeHeap, i)
+			ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
+			close(snowflake.offerChannel)
+			i = -1
+		}
+	}
+	for id, snowflake := range ctx.idToSnowflake {
+		snowflakeHeap := ctx.heapFor(snowflake)
+		i := snowflake.index
+		if i < 0 || (i < snowflakeHeap.Len() && (*snowflakeHeap)[i] == snowflake) {
+			continue
+		}
+		repair(inconsistencyMissing)
+		snowflake.index = -1
+		delete(ctx.idToSnowflake, id)
+		ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
+		// Nothing else will send it an offer, so wake its poll.
+		close(snowflake.offerChannel)
+	}
+	return repaired
+}
@@ -0,0 +1,124 @@
+/*
+Batched proxy polls, with which a proxy that can serve many clients asks for
+several offers at once. Each offer is matched with a snowflake registered under
+a sub-id of the proxy's sid, which the proxy then answers with.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/RACECAR-GU/snowflake/common/messages"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Maximum number of offers handed out in response to one poll.
+	maxPollBatch = 10
+	// How long to wait for further offers once the first one has arrived.
+	pollBatchWait = 1 * time.Second
+)
+
+type batchOffer struct {
+	id    string
+	offer *ClientOffer
+}
+
+// Returns the id of the i-th snowflake of a batched poll by the proxy sid.
+func batchSubID(sid string, i int) string {
+	return fmt.Sprintf("%s-%d", sid, i)
+}
+
+// Registers a snowflake for each of up to batch offers and waits for the first
+// offer, then up to pollBatchWait for the rest. Returns the offers received,
+// which are empty if none arrived before timeout, or the proxy timeout if
+// zero. Snowflakes turned away for want of a free match worker get no offer.
+func (ctx *BrokerContext) RequestOffers(sid string, proxyType string, natType string, tier string, region string, reportedLoad float64, timeout time.Duration, batch int) []batchOffer {
+	if batch > maxPollBatch {
+		batch = maxPollBatch
+	}
+	results := make(chan batchOffer, batch)
+	for i := 0; i < batch; i++ {
+		go func(id string) {
+			offer, _ := ctx.requestTieredOffer(id, proxyType, natType, tier, region, reportedLoad, timeout)
+			results <- batchOffer{id, offer}
+		}(batchSubID(sid, i))
+	}
+
+	var offers []batchOffer
+	pending := batch
+	collect := func(result batchOffer) {
+		pending--
+		if result.offer != nil {
+			offers = append(offers, result)
+		}
+	}
+
+	// Each snowflake yields an offer or times out, so this loop ends by the
+	// proxy timeout at the latest.
+	var deadline <-chan time.Time
+	for pending > 0 && deadline == nil {
+		collect(<-results)
+		if len(offers) > 0 {
+			deadline = time.After(pollBatchWait)
+		}
+	}
+	for waiting := true; pending > 0 && waiting; {
+		select {
+		case result := <-results:
+			collect(result)
+		case <-deadline:
+			waiting = false
+		}
+	}
+
+	// Withdraw the snowflakes still waiting. Any one a client has already
+	// taken is about to be sent its offer, which is kept.
+	ctx.snowflakeLock.Lock()
+	for i := 0; i < batch; i++ {
+		if snowflake := ctx.RemoveByID(batchSubID(sid, i)); snowflake != nil {
+			close(snowflake.offerChannel)
+		}
+	}
+	ctx.snowflakeLock.Unlock()
+	for pending > 0 {
+		collect(<-results)
+	}
+	return offers
+}
+
+func proxyBatchPolls(ctx *BrokerContext, w http.ResponseWriter, r *http.Request, sid string, proxyType string, natType string, tier string, region string, reportedLoad float64, timeout time.Duration, batch int) {
+	offers := ctx.RequestOffers(sid, proxyType, natType, tier, region, reportedLoad, timeout, batch)
+
+	ctx.metrics.lock.Lock()
+	if len(offers) == 0 {
+		ctx.metrics.proxyIdleCount++
+		ctx.metrics.promMetrics.ProxyPollTotal.With(prometheus.Labels{"nat": natType, "status": "idle"}).Inc()
+	} else {
+		ctx.metrics.promMetrics.ProxyPollTotal.With(prometheus.Labels{"nat": natType, "status": "matched"}).Inc()
+	}
+	ctx.metrics.lock.Unlock()
+
+	pollOffers := make([]messages.ProxyPollOffer, 0, len(offers))
+	for _, offer := range offers {
+		pollOffers = append(pollOffers, messages.ProxyPollOffer{
+			Sid:      offer.id,
+			Offer:    string(offer.offer.sdp),
+			NAT:      offer.offer.natType,
+			Encoding: offer.offer.encoding,
+		})
+	}
+	b, err := messages.EncodeICEBatchPollResponse(pollOffers, ctx.iceServers)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := writeResponseBody(w, r, b); err != nil {
+		log.Printf("proxyPolls unable to write offers with error: %v", err)
+		ctx.metrics.promMetrics.ResponseWriteErrorTotal.With(prometheus.Labels{"endpoint": "proxy"}).Inc()
+	}
+}
@@ -0,0 +1,138 @@
+/*
+A list of IP address ranges whose clients and proxies the broker refuses to
+serve, loaded from a file of CIDR ranges, one per line. Lines may also hold a
+single address, and everything after a '#' is a comment.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A node of a binary trie over the bits of IP addresses. A blocked node
+// blocks every address whose prefix leads to it.
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	blocked  bool
+}
+
+func (n *ipTrieNode) insert(ip []byte, prefixLen int) {
+	for i := 0; i < prefixLen && !n.blocked; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = new(ipTrieNode)
+		}
+		n = n.children[bit]
+	}
+	n.blocked = true
+	// Longer prefixes below this one are now redundant.
+	n.children = [2]*ipTrieNode{}
+}
+
+func (n *ipTrieNode) contains(ip []byte) bool {
+	for i := 0; n != nil; i++ {
+		if n.blocked {
+			return true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		n = n.children[bit]
+	}
+	return false
+}
+
+type Blocklist struct {
+	lock sync.RWMutex
+	v4   *ipTrieNode
+	v6   *ipTrieNode
+}
+
+func NewBlocklist() *Blocklist {
+	return &Blocklist{v4: new(ipTrieNode), v6: new(ipTrieNode)}
+}
+
+// Replaces the blocked ranges with those in the file. The old ranges stay in
+// effect if the file cannot be read or parsed.
+func (b *Blocklist) Load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v4, v6, err := parseBlocklist(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	b.lock.Lock()
+	b.v4, b.v6 = v4, v6
+	b.lock.Unlock()
+	return nil
+}
+
+func parseBlocklist(r io.Reader) (*ipTrieNode, *ipTrieNode, error) {
+	v4, v6 := new(ipTrieNode), new(ipTrieNode)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		prefixLen, bits := ipNet.Mask.Size()
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			// An IPv4-mapped IPv6 range, such as ::ffff:192.0.2.0/120.
+			if bits == 8*net.IPv6len {
+				prefixLen -= 8 * (net.IPv6len - net.IPv4len)
+				if prefixLen < 0 {
+					return nil, nil, fmt.Errorf("line %d: range %s is too wide", lineno, line)
+				}
+			}
+			v4.insert(ip4, prefixLen)
+		} else {
+			v6.insert(ipNet.IP.To16(), prefixLen)
+		}
+	}
+	return v4, v6, scanner.Err()
+}
+
+// Returns the tries of blocked IPv4 and IPv6 ranges.
+func (b *Blocklist) tries() (*ipTrieNode, *ipTrieNode) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.v4, b.v6
+}
+
+func (b *Blocklist) Contains(ip net.IP) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		return b.v4.contains(ip4)
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return b.v6.contains(ip16)
+	}
+	return false
+}
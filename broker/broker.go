@@ -6,26 +6,39 @@ SessionDescriptions in order to negotiate a WebRTC connection.
 package broker
 
 import (
+	"bytes"
 	"container/heap"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/RACECAR-GU/snowflake/common/messages"
 	"github.com/RACECAR-GU/snowflake/common/safelog"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
@@ -33,29 +46,232 @@ const (
 	ProxyTimeout  = 10
 	readLimit     = 100000 //Maximum number of bytes to be read from an HTTP request
 
+	metricsTailLimit = 512 * 1024 //Maximum number of bytes of the metrics file to be served
+
+	// Bounds on the timeout a client may ask for with the
+	// Snowflake-Client-Timeout header.
+	minClientTimeout        = 1 * time.Second
+	defaultMaxClientTimeout = 30 * time.Second
+	// Bounds on how long a proxy may ask to wait for an offer with the Wait
+	// field of its poll.
+	minProxyTimeout        = 1 * time.Second
+	defaultMaxProxyTimeout = 30 * time.Second
+
+	// How long requests in progress have to finish when shutting down.
+	shutdownTimeout = 15 * time.Second
+
+	// How long browsers may cache a CORS preflight response.
+	defaultCORSMaxAge = 24 * time.Hour
+
+	// How long each attempt to hand an answer to its client waits.
+	answerRetryInterval = 100 * time.Millisecond
+	// Longest all the attempts to hand an answer to its client take together.
+	defaultAnswerDeliverTimeout = 1 * time.Second
+	// Capacity of each snowflake's offer and answer channels.
+	defaultChannelBuffer = 1
+
+	// Failed matches in a row after which a proxy is asked to detect its NAT
+	// type again.
+	defaultNATRedetectAfter = 3
+
+	// Most of the client offers shed when overloaded, so that some are still
+	// matched and update the roundtrip estimate that decides the shedding.
+	maxShedProbability = 0.9
+	// How long shed clients are asked to wait before retrying.
+	shedRetryAfter = 5 * time.Second
+	// How long clients turned away while the broker is waiting for its first
+	// proxies are asked to wait before retrying.
+	warmUpRetryAfter = 10 * time.Second
+
+	// Longest proxy session id accepted. Proxies send 22 characters of
+	// base64.
+	maxSessionIDLength = 64
+
+	// How long a proxy poll waits for the Broker loop to take it before it
+	// is answered as idle.
+	defaultProxyPollSendTimeout = 5 * time.Second
+
 	NATUnknown      = "unknown"
 	NATRestricted   = "restricted"
 	NATUnrestricted = "unrestricted"
+	// The proxy_nat label of client polls that no proxy was matched with.
+	proxyNATNone = "none"
+
+	MatchLeastLoaded = "least-loaded"
+	MatchRoundRobin  = "round-robin"
 )
 
 type BrokerContext struct {
 	snowflakes           *SnowflakeHeap
 	restrictedSnowflakes *SnowflakeHeap
+	// Snowflakes of trusted proxies polling with a tier, which are offered
+	// first to clients asking for priority.
+	prioritySnowflakes           *SnowflakeHeap
+	priorityRestrictedSnowflakes *SnowflakeHeap
 	// Maps keeping track of snowflakeIDs required to match SDP answers from
 	// the second http POST. Restricted snowflakes can only be matched up with
 	// clients behind an unrestricted NAT.
 	idToSnowflake map[string]*Snowflake
+	// Most entries kept in idToSnowflake, beyond which the oldest are evicted,
+	// as a safety net should some path fail to forget them. Unbounded if
+	// zero.
+	maxTrackedProxies int
 	// Synchronization for the snowflake map and heap
 	snowflakeLock sync.Mutex
-	proxyPolls    chan *ProxyPoll
-	metrics       *Metrics
+	// Number of snowflakes added so far, for ordering them by arrival.
+	snowflakeSeq uint64
+	proxyPolls   chan *ProxyPoll
+	metrics      *Metrics
+	// How long a poll waits to be sent on proxyPolls, so that polls are shed
+	// rather than pile up if the Broker loop stalls.
+	proxyPollSendTimeout time.Duration
+	// Slots for the goroutines matching proxy polls with clients, bounding
+	// how many polls wait at once. Unbounded if nil.
+	matchWorkers chan struct{}
+	// Slots for client offers being handled, bounding how many clients wait
+	// for an answer at once. Unbounded if nil.
+	inflightClients chan struct{}
+	// Hashed identifiers of clients, by which their offers are rate
+	// limited. Shared with the pools of other virtual hosts.
+	clientIDs *clientIDs
+	// Client roundtrip estimate above which client offers are shed, a
+	// growing fraction of them the further it is exceeded. Disabled if zero.
+	shedLatency time.Duration
+	// Number of snowflakes that must first be available at once before client
+	// offers are accepted, so that the first clients after startup aren't
+	// denied while proxies are still arriving. Accessed atomically, warmedUp
+	// is set once they have been.
+	minProxiesBeforeServing int
+	warmedUp                int32
+
+	// Clients waiting up to clientQueueWait for a snowflake when none are
+	// available. Waiting is disabled if clientQueueWait is zero.
+	waitingForSnowflakes           chan *waitingClient
+	waitingForRestrictedSnowflakes chan *waitingClient
+	clientQueueWait                time.Duration
+	// Offers older than this when matched, such as after waiting in the
+	// client queue, are denied rather than relayed, since their ICE
+	// candidates may no longer be valid. Unbounded if zero.
+	maxOfferAge time.Duration
+
+	statusCache statusCache
+	// Session ids of the clients with an offer in flight.
+	clientSessions clientSessions
+	// When proxy ids were first seen, to age out long-lived ones.
+	proxyLifetimes proxyLifetimes
+	// Failed matches of proxies, to ask them to redetect their NAT types.
+	natRedetection natRedetection
+	// Failed answers of proxies, to refuse those that keep failing.
+	proxyQuarantine proxyQuarantine
+	// When proxy ids last polled, to count those gone quiet.
+	proxyHeartbeats proxyHeartbeats
+	// Proxies whose answers were delivered, which may acknowledge whether
+	// they connected.
+	pendingAcks pendingAcks
+	// Success rates of proxies, from their acknowledgements.
+	proxyQuality proxyQuality
+
+	// Accessed atomically; see Draining.
+	draining int32
+	// Guards adminToken, proxyTiers, and allowedProxyTypes, which are
+	// replaced on reload.
+	reloadLock sync.RWMutex
+	// Bearer token required by the admin endpoints, which are disabled if it
+	// is empty.
+	adminToken string
+	// Basic authentication required by the metrics endpoints, if not nil.
+	metricsAuth *basicAuthCredentials
+	// The configuration in effect, shown by /admin/config.
+	config *effectiveConfig
+	// Maps the bearer tokens of tiered proxies to the tier each may poll with.
+	proxyTiers map[string]string
+
+	// How long clients wait for an answer, and proxies for an offer.
+	clientTimeout time.Duration
+	proxyTimeout  time.Duration
+	// Longest timeout a client may ask for in place of clientTimeout.
+	maxClientTimeout time.Duration
+	// Longest wait a proxy may ask for in place of proxyTimeout.
+	maxProxyTimeout time.Duration
+	// Longest a client offer may take from its arrival to its proxy's
+	// answer, queueing included. Unlimited if zero.
+	matchDeadline time.Duration
+	// Bounds of the proxy timeout adapting to the rate at which clients
+	// arrive, which does not adapt if the minimum is zero, and is bounded by
+	// proxyTimeout if the maximum is.
+	minAdaptiveProxyTimeout time.Duration
+	maxAdaptiveProxyTimeout time.Duration
+	clientArrivals          clientArrivals
+	// Client timeouts in place of clientTimeout when matched with snowflakes
+	// of the NAT types present, for pairs that take longer to connect.
+	clientTimeoutByNAT map[string]time.Duration
+	// Number of further attempts to hand an answer to its client, each
+	// waiting answerRetryInterval, before giving up on it.
+	answerRetries int
+	// Longest the attempts to hand an answer to its client may take
+	// together, however many retries are left.
+	answerDeliverTimeout time.Duration
+	// Capacity of each snowflake's offer and answer channels, so that an
+	// offer or answer can be handed over without waiting for the other side
+	// to be ready for it.
+	channelBuffer int
+	// Fraction by which each proxy's timeout is randomly lengthened or
+	// shortened, so that proxies polling together don't all re-poll together.
+	// jitterRand is used only by the Broker goroutine.
+	timeoutJitter float64
+	jitterRand    *rand.Rand
+
+	// Value of the Access-Control-Allow-Origin header on signaling responses.
+	corsOrigin string
+	// Value of the Access-Control-Max-Age header on preflight responses.
+	corsMaxAge time.Duration
+	// If not empty, the only origins allowed to make cross-origin requests,
+	// each echoed back in place of corsOrigin.
+	corsAllowedOrigins map[string]bool
+	// Sampled log of match events, or nil if disabled.
+	eventLog *eventLog
+	// Broker to which offers and polls are mirrored, or nil if none.
+	shadow *shadowBroker
+	// Whether to reject client offers and proxy answers whose SDP lacks a
+	// DTLS fingerprint or media section.
+	requireSDPFingerprint bool
+	// If not empty, the URL of a sibling broker that clients denied a
+	// snowflake are pointed at to retry with.
+	fallbackBrokerURL string
+	// Page served at the root path, which is not found if nil.
+	decoyPage []byte
+	// How clients are matched with snowflakes, MatchLeastLoaded or
+	// MatchRoundRobin.
+	matchStrategy string
+	// Logs each match decision at the debug level, or nil at other levels.
+	matchLog *log.Logger
+	// Whether snowflakes less likely to connect, by their success rates, are
+	// matched as if serving more clients.
+	qualityMatching bool
+	// Whether clients asking for a region are matched with the snowflakes of
+	// that region first.
+	regionMatching bool
+	// Whether restricted clients are matched with restricted snowflakes when
+	// there are no unrestricted ones.
+	allowRestrictedFallback bool
+	// Number of snowflakes each client offer is passed to at once, of which
+	// the first to answer is used.
+	clientFanout int
+	// Relative capacities of proxy types, 1 for types not listed.
+	proxyTypeWeights map[string]float64
+	// If not empty, the only proxy types allowed to poll.
+	allowedProxyTypes map[string]bool
+	// Regions proxies may declare themselves in; others are treated as
+	// none.
+	allowedRegions map[string]bool
+	// URLs of STUN or TURN servers suggested to proxies matched with a
+	// client.
+	iceServers []string
+	// Pools of other virtual hosts made from this context by newPool.
+	vhostPools []*BrokerContext
 }
 
 func NewBrokerContext(metricsLogger *log.Logger) *BrokerContext {
-	snowflakes := new(SnowflakeHeap)
-	heap.Init(snowflakes)
-	rSnowflakes := new(SnowflakeHeap)
-	heap.Init(rSnowflakes)
 	metrics, err := NewMetrics(metricsLogger)
 
 	if err != nil {
@@ -66,12 +282,49 @@ func NewBrokerContext(metricsLogger *log.Logger) *BrokerContext {
 		panic("Failed to create metrics")
 	}
 
+	return newBrokerContext(metrics)
+}
+
+// Returns a context with empty pools, recording into metrics.
+func newBrokerContext(metrics *Metrics) *BrokerContext {
+	snowflakes := new(SnowflakeHeap)
+	heap.Init(snowflakes)
+	rSnowflakes := new(SnowflakeHeap)
+	heap.Init(rSnowflakes)
+	pSnowflakes := new(SnowflakeHeap)
+	heap.Init(pSnowflakes)
+	prSnowflakes := new(SnowflakeHeap)
+	heap.Init(prSnowflakes)
+
 	return &BrokerContext{
 		snowflakes:           snowflakes,
 		restrictedSnowflakes: rSnowflakes,
 		idToSnowflake:        make(map[string]*Snowflake),
 		proxyPolls:           make(chan *ProxyPoll),
 		metrics:              metrics,
+		proxyPollSendTimeout: defaultProxyPollSendTimeout,
+
+		prioritySnowflakes:           pSnowflakes,
+		priorityRestrictedSnowflakes: prSnowflakes,
+
+		waitingForSnowflakes:           make(chan *waitingClient, clientQueueSize),
+		waitingForRestrictedSnowflakes: make(chan *waitingClient, clientQueueSize),
+
+		clientTimeout:    ClientTimeout * time.Second,
+		proxyTimeout:     ProxyTimeout * time.Second,
+		maxClientTimeout: defaultMaxClientTimeout,
+		maxProxyTimeout:  defaultMaxProxyTimeout,
+		clientFanout:     1,
+		jitterRand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		corsOrigin:       "*",
+		corsMaxAge:       defaultCORSMaxAge,
+		matchStrategy:    MatchLeastLoaded,
+		natRedetection:   natRedetection{threshold: defaultNATRedetectAfter},
+		clientIDs:        new(clientIDs),
+
+		answerRetries:        3,
+		answerDeliverTimeout: defaultAnswerDeliverTimeout,
+		channelBuffer:        defaultChannelBuffer,
 	}
 }
 
@@ -88,10 +341,21 @@ type MetricsHandler struct {
 }
 
 func (sh SnowflakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Session-ID, Snowflake-NAT-Type")
+	if len(sh.corsAllowedOrigins) > 0 {
+		// The header depends on the request's origin, so caches must not
+		// share responses between origins.
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); sh.corsAllowedOrigins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", sh.corsOrigin)
+	}
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Session-ID, Snowflake-NAT-Type, Snowflake-Proxy-Type-Preference, Snowflake-Priority, Snowflake-Region, Snowflake-Client-Timeout, Snowflake-Offer-Encoding, Content-Encoding")
+	w.Header().Set("Access-Control-Expose-Headers", "Snowflake-Answer-Encoding")
 	// Return early if it's CORS preflight.
 	if "OPTIONS" == r.Method {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(sh.corsMaxAge.Seconds())))
 		return
 	}
 	sh.handle(sh.BrokerContext, w, r)
@@ -112,21 +376,61 @@ type ProxyPoll struct {
 	id           string
 	proxyType    string
 	natType      string
+	tier         string
+	region       string
+	reportedLoad float64
+	// How long the proxy asked to wait for an offer, or zero for the
+	// jittered proxyTimeout.
+	timeout      time.Duration
 	offerChannel chan *ClientOffer
+	// Set before offerChannel is closed if no match worker was free.
+	busy bool
 }
 
+var errBrokerBusy = errors.New("no match worker is free")
+
 // Registers a Snowflake and waits for some Client to send an offer,
 // as part of the polling logic of the proxy handler.
 func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType string) *ClientOffer {
+	return ctx.RequestTieredOffer(id, proxyType, natType, "")
+}
+
+// Like RequestOffer, but for a trusted proxy registering in the priority pool
+// if tier is not empty.
+func (ctx *BrokerContext) RequestTieredOffer(id string, proxyType string, natType string, tier string) *ClientOffer {
+	offer, _ := ctx.requestTieredOffer(id, proxyType, natType, tier, "", 0, 0)
+	return offer
+}
+
+// Like RequestTieredOffer, but for a proxy in region, which is empty if it
+// declared none allowed, reporting the fraction of its capacity in use and
+// waiting up to timeout for an offer, or the proxy timeout if zero. Returns
+// errBrokerBusy without waiting if every match worker is busy.
+func (ctx *BrokerContext) requestTieredOffer(id string, proxyType string, natType string, tier string, region string, reportedLoad float64, timeout time.Duration) (*ClientOffer, error) {
 	request := new(ProxyPoll)
 	request.id = id
 	request.proxyType = proxyType
 	request.natType = natType
+	request.tier = tier
+	request.region = region
+	request.reportedLoad = reportedLoad
+	request.timeout = timeout
 	request.offerChannel = make(chan *ClientOffer)
-	ctx.proxyPolls <- request
+	timer := time.NewTimer(ctx.proxyPollSendTimeout)
+	select {
+	case ctx.proxyPolls <- request:
+		timer.Stop()
+	case <-timer.C:
+		// The Broker loop isn't keeping up; answer the proxy as idle.
+		ctx.metrics.promMetrics.ProxyPollBackpressureTotal.Inc()
+		return nil, nil
+	}
 	// Block until an offer is available, or timeout which sends a nil offer.
 	offer := <-request.offerChannel
-	return offer
+	if request.busy {
+		return nil, errBrokerBusy
+	}
+	return offer, nil
 }
 
 // goroutine which matches clients to proxies and sends SDP offers along.
@@ -134,114 +438,613 @@ func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType stri
 // client offer or nil on timeout / none are available.
 func (ctx *BrokerContext) Broker() {
 	for request := range ctx.proxyPolls {
-		snowflake := ctx.AddSnowflake(request.id, request.proxyType, request.natType)
+		// Turn the poll away rather than queue it if all match workers are
+		// busy, so that a flood of polls can't pile up goroutines.
+		if ctx.matchWorkers != nil {
+			select {
+			case ctx.matchWorkers <- struct{}{}:
+			default:
+				request.busy = true
+				close(request.offerChannel)
+				continue
+			}
+		}
+		snowflake := ctx.addSnowflake(request.id, request.proxyType, request.natType, request.tier, request.region, request.reportedLoad)
+		ctx.serveWaitingClient(snowflake)
+		// A proxy that chose its own wait is not jittered, since it has
+		// already decided when to poll again.
+		timeout := request.timeout
+		if timeout == 0 {
+			timeout = ctx.jitteredProxyTimeout()
+		}
+		added := time.Now()
 		// Wait for a client to avail an offer to the snowflake.
+		ctx.metrics.promMetrics.MatchGoroutines.Inc()
 		go func(request *ProxyPoll) {
+			defer ctx.metrics.promMetrics.MatchGoroutines.Dec()
+			if ctx.matchWorkers != nil {
+				defer func() { <-ctx.matchWorkers }()
+			}
 			select {
 			case offer := <-snowflake.offerChannel:
 				request.offerChannel <- offer
-			case <-time.After(time.Second * ProxyTimeout):
+			case <-time.After(timeout):
 				// This snowflake is no longer available to serve clients.
 				ctx.snowflakeLock.Lock()
-				defer ctx.snowflakeLock.Unlock()
-				if snowflake.index != -1 {
-					if request.natType == NATUnrestricted {
-						heap.Remove(ctx.snowflakes, snowflake.index)
-					} else {
-						heap.Remove(ctx.restrictedSnowflakes, snowflake.index)
-					}
-					ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": request.natType, "type": request.proxyType}).Dec()
-					delete(ctx.idToSnowflake, snowflake.id)
+				withdrawn := ctx.withdrawSnowflake(snowflake)
+				ctx.snowflakeLock.Unlock()
+				if withdrawn {
+					ctx.metrics.promMetrics.ProxyIdleDuration.Observe(time.Since(added).Seconds())
 					close(request.offerChannel)
+				} else {
+					// Whoever took the snowflake from the heap just as it
+					// timed out will send it an offer or close its channel.
+					request.offerChannel <- <-snowflake.offerChannel
 				}
 			}
 		}(request)
 	}
 }
 
+// Removes a snowflake that is still waiting for a client from the heap and the
+// id map, returning false if it has already been taken out of the heap. The
+// caller must hold snowflakeLock.
+func (ctx *BrokerContext) withdrawSnowflake(snowflake *Snowflake) bool {
+	if !ctx.heapFor(snowflake).Remove(snowflake) {
+		return false
+	}
+	ctx.metrics.promMetrics.ProxyLoad.Observe(snowflake.load())
+	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
+	if ctx.idToSnowflake[snowflake.id] == snowflake {
+		delete(ctx.idToSnowflake, snowflake.id)
+	}
+	return true
+}
+
+// Removes the snowflake registered with id from its heap and the id map, if it
+// is still waiting for a client, and returns it. Returns nil if there is no
+// such snowflake. The caller must hold snowflakeLock.
+func (ctx *BrokerContext) RemoveByID(id string) *Snowflake {
+	snowflake, ok := ctx.idToSnowflake[id]
+	if !ok || !ctx.withdrawSnowflake(snowflake) {
+		return nil
+	}
+	return snowflake
+}
+
+// Returns the effective proxy timeout adjusted by a random amount of up to
+// timeoutJitter of itself in either direction.
+func (ctx *BrokerContext) jitteredProxyTimeout() time.Duration {
+	timeout := ctx.effectiveProxyTimeout()
+	if ctx.timeoutJitter <= 0 {
+		return timeout
+	}
+	factor := 1 + ctx.timeoutJitter*(2*ctx.jitterRand.Float64()-1)
+	return time.Duration(float64(timeout) * factor)
+}
+
+// Returns the heap that holds, or would hold, the snowflake.
+func (ctx *BrokerContext) heapFor(snowflake *Snowflake) *SnowflakeHeap {
+	if snowflake.tier != "" {
+		if snowflake.natType == NATUnrestricted {
+			return ctx.prioritySnowflakes
+		}
+		return ctx.priorityRestrictedSnowflakes
+	}
+	if snowflake.natType == NATUnrestricted {
+		return ctx.snowflakes
+	}
+	return ctx.restrictedSnowflakes
+}
+
 // Create and add a Snowflake to the heap.
 // Required to keep track of proxies between providing them
 // with an offer and awaiting their second POST with an answer.
 func (ctx *BrokerContext) AddSnowflake(id string, proxyType string, natType string) *Snowflake {
+	return ctx.AddTieredSnowflake(id, proxyType, natType, "")
+}
+
+// Like AddSnowflake, but adds the snowflake to the priority pool if tier is
+// not empty.
+func (ctx *BrokerContext) AddTieredSnowflake(id string, proxyType string, natType string, tier string) *Snowflake {
+	return ctx.addSnowflake(id, proxyType, natType, tier, "", 0)
+}
+
+// Like AddTieredSnowflake, but for a proxy in region, or none if empty,
+// reporting the fraction of its capacity in use, by which it sorts later among
+// snowflakes serving as many clients.
+func (ctx *BrokerContext) addSnowflake(id string, proxyType string, natType string, tier string, region string, reportedLoad float64) *Snowflake {
 	snowflake := new(Snowflake)
 	snowflake.id = id
 	snowflake.clients = 0
 	snowflake.proxyType = proxyType
 	snowflake.natType = natType
-	snowflake.offerChannel = make(chan *ClientOffer)
-	snowflake.answerChannel = make(chan []byte)
+	snowflake.tier = tier
+	snowflake.region = region
+	snowflake.weight = ctx.proxyTypeWeights[proxyType]
+	snowflake.reportedLoad = reportedLoad
+	if ctx.qualityMatching {
+		snowflake.unreliability = 1 - ctx.proxyQuality.rate(id)
+	}
+	snowflake.offerChannel = make(chan *ClientOffer, ctx.channelBuffer)
+	snowflake.answerChannel = make(chan []byte, ctx.channelBuffer)
 	ctx.snowflakeLock.Lock()
-	if natType == NATUnrestricted {
-		heap.Push(ctx.snowflakes, snowflake)
-	} else {
-		heap.Push(ctx.restrictedSnowflakes, snowflake)
+	// A proxy may poll again with the same id, for instance after a network
+	// hiccup. Replace a previous registration still waiting in the heap so
+	// that it does not linger. One already matched with a client is left to
+	// finish, but the id now refers to the new registration.
+	if old, ok := ctx.idToSnowflake[id]; ok && ctx.withdrawSnowflake(old) {
+		// Wakes up the Broker goroutine waiting on the old registration.
+		close(old.offerChannel)
 	}
+	snowflake.seq = ctx.snowflakeSeq
+	snowflake.added = time.Now()
+	ctx.snowflakeSeq++
+	heap.Push(ctx.heapFor(snowflake), snowflake)
 	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": natType, "type": proxyType}).Inc()
-	ctx.snowflakeLock.Unlock()
 	ctx.idToSnowflake[id] = snowflake
+	if ctx.minProxiesBeforeServing > 0 && atomic.LoadInt32(&ctx.warmedUp) == 0 {
+		available := ctx.snowflakes.Len() + ctx.restrictedSnowflakes.Len() +
+			ctx.prioritySnowflakes.Len() + ctx.priorityRestrictedSnowflakes.Len()
+		if available >= ctx.minProxiesBeforeServing {
+			log.Printf("Serving clients, with %d proxies available.", available)
+			atomic.StoreInt32(&ctx.warmedUp, 1)
+		}
+	}
+	if ctx.maxTrackedProxies > 0 && len(ctx.idToSnowflake) > ctx.maxTrackedProxies {
+		ctx.evictOldestSnowflakes(len(ctx.idToSnowflake) - ctx.maxTrackedProxies)
+	}
+	ctx.snowflakeLock.Unlock()
 	return snowflake
 }
 
+// Forgets up to n of the snowflakes added longest ago. Those still waiting for
+// a client are withdrawn, and respond to their proxies' polls with no offer.
+// Those matched with a client are kept until their match has outlasted the
+// longest it may take, so that their proxies can still answer. The caller must
+// hold snowflakeLock.
+func (ctx *BrokerContext) evictOldestSnowflakes(n int) {
+	snowflakes := make([]*Snowflake, 0, len(ctx.idToSnowflake))
+	for _, snowflake := range ctx.idToSnowflake {
+		snowflakes = append(snowflakes, snowflake)
+	}
+	sort.Slice(snowflakes, func(i, j int) bool {
+		return snowflakes[i].seq < snowflakes[j].seq
+	})
+	longestMatch := ctx.longestClientTimeout() + ctx.answerDeliverTimeout
+	evicted := 0
+	for _, snowflake := range snowflakes {
+		if evicted == n {
+			break
+		}
+		if ctx.withdrawSnowflake(snowflake) {
+			close(snowflake.offerChannel)
+		} else {
+			matched := snowflake.offerSent
+			if matched.IsZero() {
+				matched = snowflake.added
+			}
+			if time.Since(matched) <= longestMatch {
+				continue
+			}
+			delete(ctx.idToSnowflake, snowflake.id)
+		}
+		ctx.metrics.promMetrics.EvictedStaleProxyTotal.Inc()
+		evicted++
+	}
+	log.Printf("Warning: tracking more than %d proxies, evicted the %d oldest.", ctx.maxTrackedProxies, evicted)
+}
+
+// Returns the longest a client may wait for the answer of the snowflake it
+// was matched with.
+func (ctx *BrokerContext) longestClientTimeout() time.Duration {
+	longest := ctx.clientTimeout
+	if ctx.maxClientTimeout > longest {
+		longest = ctx.maxClientTimeout
+	}
+	for _, timeout := range ctx.clientTimeoutByNAT {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
+
+// Reports whether sid looks like a session id a proxy would generate: not too
+// long, and only of the characters of standard or URL-safe base64. Others are
+// rejected before they are logged or used as map keys.
+func validSessionID(sid string) bool {
+	if len(sid) == 0 || len(sid) > maxSessionIDLength {
+		return false
+	}
+	for _, c := range sid {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '+' || c == '/' || c == '-' || c == '_' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 /*
 For snowflake proxies to request a client from the Broker.
 */
 func proxyPolls(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	if ctx.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
 	if err != nil {
 		log.Println("Invalid data.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "proxy", "reason": "unreadable"}).Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	sid, proxyType, natType, err := messages.DecodePollRequest(body)
+	poll, err := messages.DecodePollRequestMessage(body)
 	if err != nil {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "proxy", "reason": "undecodable"}).Inc()
+		var decodeErr *messages.PollDecodeError
+		if errors.As(err, &decodeErr) {
+			ctx.metrics.promMetrics.PollDecodeFailTotal.With(prometheus.Labels{"field": decodeErr.Field}).Inc()
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if poll.UnknownNAT {
+		ctx.metrics.promMetrics.PollDecodeFailTotal.With(prometheus.Labels{"field": messages.PollFieldNAT}).Inc()
+	}
+	sid, proxyType, natType, batch := poll.Sid, poll.Type, poll.NAT, poll.Batch
+	if !validSessionID(sid) {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "proxy", "reason": "invalid_sid"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Even polls refused below show the proxy is still alive.
+	ctx.proxyHeartbeats.poll(sid)
+
+	ctx.reloadLock.RLock()
+	allowed := len(ctx.allowedProxyTypes) == 0 || ctx.allowedProxyTypes[proxyType]
+	ctx.reloadLock.RUnlock()
+	if !allowed {
+		ctx.metrics.promMetrics.ProxyTypeRejectedTotal.Inc()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !ctx.proxyLifetimes.allow(sid) {
+		ctx.metrics.promMetrics.ProxyLifetimeRefusedTotal.Inc()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if ctx.proxyQuarantine.quarantined(sid) {
+		ctx.metrics.promMetrics.ProxyQuarantineRefusedTotal.Inc()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Only proxies holding a token for their tier may join the priority pool.
+	if poll.Tier != "" && !ctx.authorizedTier(r, poll.Tier) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ctx.shadowProxyPoll(sid, proxyType, natType)
+
+	// Regions not allowed are ignored rather than refused, so that a proxy
+	// declaring one the broker no longer lists still serves clients.
+	region := ctx.allowedRegion(poll.Region)
+	ctx.metrics.promMetrics.ProxyPollRegionTotal.With(prometheus.Labels{"region": regionLabel(region)}).Inc()
+
+	ctx.metrics.lock.Lock()
+	ctx.metrics.UpdateNATHistory(sid, natType)
+	ctx.metrics.lock.Unlock()
 
-	// Log geoip stats
+	// Log geoip stats, and count the proxy by country while it polls.
 	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Println("Error processing proxy IP: ", err.Error())
 	} else {
 		ctx.metrics.lock.Lock()
 		ctx.metrics.UpdateCountryStats(remoteIP, proxyType, natType)
+		country := ctx.metrics.AddLiveProxy(remoteIP)
 		ctx.metrics.lock.Unlock()
+		defer func() {
+			ctx.metrics.lock.Lock()
+			ctx.metrics.RemoveLiveProxy(country)
+			ctx.metrics.lock.Unlock()
+		}()
+	}
+
+	if batch > 1 {
+		proxyBatchPolls(ctx, w, r, sid, proxyType, natType, poll.Tier, region, poll.Load, ctx.requestProxyTimeout(poll.Wait), batch)
+		return
 	}
 
 	// Wait for a client to avail an offer to the snowflake, or timeout if nil.
-	offer := ctx.RequestOffer(sid, proxyType, natType)
+	offer, err := ctx.requestTieredOffer(sid, proxyType, natType, poll.Tier, region, poll.Load, ctx.requestProxyTimeout(poll.Wait))
+	if err == errBrokerBusy {
+		ctx.eventLog.record(matchEvent{Event: eventProxyPoll, ProxyNAT: natType, ProxyType: proxyType, Outcome: "busy"})
+		ctx.metrics.lock.Lock()
+		ctx.metrics.promMetrics.ProxyPollTotal.With(prometheus.Labels{"nat": natType, "status": "busy"}).Inc()
+		ctx.metrics.lock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	// A proxy that has just redetected its NAT type polls with the new one,
+	// which requestTieredOffer has already put in place of the old.
+	redetectNAT := ctx.natRedetection.poll(sid, natType)
+	if redetectNAT {
+		ctx.metrics.promMetrics.ProxyNATRedetectTotal.Inc()
+	}
 	var b []byte
 	if nil == offer {
+		ctx.eventLog.record(matchEvent{Event: eventProxyPoll, ProxyNAT: natType, ProxyType: proxyType, Outcome: "idle"})
 		ctx.metrics.lock.Lock()
 		ctx.metrics.proxyIdleCount++
 		ctx.metrics.promMetrics.ProxyPollTotal.With(prometheus.Labels{"nat": natType, "status": "idle"}).Inc()
 		ctx.metrics.lock.Unlock()
 
-		b, err = messages.EncodePollResponse("", false, "")
+		b, err = messages.EncodeRedetectPollResponse("", false, "", redetectNAT)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		w.Write(b)
+		writeResponseBody(w, r, b)
 		return
 	}
+	ctx.eventLog.record(matchEvent{
+		Event:     eventProxyPoll,
+		ClientNAT: offer.natType,
+		ProxyNAT:  natType,
+		ProxyType: proxyType,
+		Outcome:   "matched",
+	})
 	ctx.metrics.promMetrics.ProxyPollTotal.With(prometheus.Labels{"nat": natType, "status": "matched"}).Inc()
-	b, err = messages.EncodePollResponse(string(offer.sdp), true, offer.natType)
+	b, err = messages.EncodeICEPollResponse(string(offer.sdp), offer.natType, offer.encoding, redetectNAT, ctx.iceServers)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if _, err := w.Write(b); err != nil {
+	if err := writeResponseBody(w, r, b); err != nil {
 		log.Printf("proxyPolls unable to write offer with error: %v", err)
+		ctx.metrics.promMetrics.ResponseWriteErrorTotal.With(prometheus.Labels{"endpoint": "proxy"}).Inc()
+	}
+}
+
+/*
+For snowflake proxies that are shutting down to withdraw from the Broker
+before their poll times out, so that no client is matched with them.
+*/
+func proxyDeregister(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if err != nil {
+		log.Println("Invalid data.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "deregister", "reason": "unreadable"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sid, err := messages.DecodeDeregisterRequest(body)
+	if err != nil {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "deregister", "reason": "undecodable"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+	// A snowflake that has already been matched with a client is left alone,
+	// so that the client's negotiation can complete or time out.
+	snowflake := ctx.RemoveByID(sid)
+	if snowflake == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
+	// Wakes up the Broker goroutine waiting on this snowflake, which then
+	// responds to the proxy's poll with no offer. Clients only send on this
+	// channel after popping the snowflake from the heap, so this is safe.
+	close(snowflake.offerChannel)
 }
 
 // Client offer contains an SDP and the NAT type of the client
 type ClientOffer struct {
 	natType string
 	sdp     []byte
+	// Tag of the envelope the SDP is wrapped in, if any, in which case sdp is
+	// opaque.
+	encoding string
+	// When the broker received the offer.
+	received time.Time
+	// Done once the client disconnects or the match deadline passes, when
+	// both the client's wait and its proxy's answer are abandoned.
+	context context.Context
+}
+
+// Returns the context of a match for the client request r, which ends with
+// the request or after matchDeadline if set.
+func (ctx *BrokerContext) matchContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if ctx.matchDeadline > 0 {
+		return context.WithTimeout(r.Context(), ctx.matchDeadline)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// Returns how long to wait for a proxy's answer to the client's offer. Clients
+// on slow networks may ask for a different timeout, in seconds, with the
+// Snowflake-Client-Timeout header; it is clamped between minClientTimeout and
+// maxClientTimeout.
+func (ctx *BrokerContext) requestClientTimeout(r *http.Request) time.Duration {
+	header := r.Header.Get("Snowflake-Client-Timeout")
+	if header == "" {
+		return ctx.clientTimeout
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || math.IsNaN(seconds) {
+		return ctx.clientTimeout
+	}
+	if seconds > ctx.maxClientTimeout.Seconds() {
+		return ctx.maxClientTimeout
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout < minClientTimeout {
+		return minClientTimeout
+	}
+	return timeout
+}
+
+// Returns how long to wait for an offer for a proxy that asked to wait for
+// seconds, clamped between minProxyTimeout and maxProxyTimeout, or zero for
+// the proxy timeout if it did not ask.
+func (ctx *BrokerContext) requestProxyTimeout(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	if seconds > ctx.maxProxyTimeout.Seconds() {
+		return ctx.maxProxyTimeout
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout < minProxyTimeout {
+		return minProxyTimeout
+	}
+	return timeout
+}
+
+// Returns how long to wait for the answer of a snowflake of natType, for
+// clients that did not ask for a timeout.
+func (ctx *BrokerContext) natClientTimeout(natType string) time.Duration {
+	if timeout, ok := ctx.clientTimeoutByNAT[natType]; ok {
+		return timeout
+	}
+	return ctx.clientTimeout
+}
+
+// Returns the NAT type a client declared with the Snowflake-NAT-Type header,
+// or NATUnknown if it declared none or one that isn't known.
+func clientNATType(header string) string {
+	switch natType := strings.ToLower(strings.TrimSpace(header)); natType {
+	case NATRestricted, NATUnrestricted:
+		return natType
+	default:
+		return NATUnknown
+	}
+}
+
+// Returns the heap to match a client of the given NAT type from. Only clients
+// known to be behind an unrestricted NAT are handed known restricted
+// snowflakes. Clients behind a restricted NAT, including those behind
+// carrier-grade NAT that say so whatever their NAT probe found, and clients
+// of unknown NAT type get unrestricted snowflakes, which any client can reach.
+func (ctx *BrokerContext) clientHeap(natType string) *SnowflakeHeap {
+	if natType == NATUnrestricted {
+		return ctx.restrictedSnowflakes
+	}
+	return ctx.snowflakes
+}
+
+// Body of the response to a client denied a snowflake, when there is a
+// fallback broker to point it at.
+type deniedResponse struct {
+	Error    string `json:"error"`
+	Fallback string `json:"fallback"`
+}
+
+// Responds to a client that no snowflake is available. If there is a fallback
+// broker, its URL is given in the Snowflake-Fallback header and in a JSON body,
+// for the client to retry its offer there; the offer itself is not forwarded.
+func (ctx *BrokerContext) writeDenied(w http.ResponseWriter) {
+	if ctx.fallbackBrokerURL == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, err := json.Marshal(deniedResponse{
+		Error:    "no snowflake proxies available",
+		Fallback: ctx.fallbackBrokerURL,
+	})
+	if err != nil {
+		log.Printf("Error encoding denied response: %s", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Snowflake-Fallback", ctx.fallbackBrokerURL)
+	w.Header().Add("Access-Control-Expose-Headers", "Snowflake-Fallback")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("unable to write denied response with error: %v", err)
+	}
+}
+
+// Removes and returns the snowflake to match a client with from snowflakeHeap,
+// by the match strategy, preferring proxyType and then region if not empty.
+// The caller must hold snowflakeLock.
+func (ctx *BrokerContext) popSnowflake(snowflakeHeap *SnowflakeHeap, proxyType string, region string) *Snowflake {
+	var snowflake *Snowflake
+	if ctx.matchStrategy == MatchRoundRobin {
+		snowflake = snowflakeHeap.PopOldestInRegion(proxyType, region)
+	} else {
+		snowflake = snowflakeHeap.PopPreferredInRegion(proxyType, region)
+	}
+	if snowflake != nil {
+		ctx.metrics.promMetrics.ProxyLoad.Observe(snowflake.load())
+	}
+	return snowflake
+}
+
+// Waits up to timeout, or until done is closed, for the first of the
+// snowflakes to answer, returning it and its answer, or nil if none did. The
+// snowflakes are then marked as no longer awaited, so that the proxies of the
+// others are told the client is gone rather than have their answers buffered.
+func (ctx *BrokerContext) waitForAnswer(snowflakes []*Snowflake, timeout time.Duration, done <-chan struct{}) (*Snowflake, []byte) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	}
+	for _, snowflake := range snowflakes {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(snowflake.answerChannel)})
+	}
+	chosen, answer, _ := reflect.Select(cases)
+
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+	for _, snowflake := range snowflakes {
+		snowflake.clientGone = true
+	}
+	if chosen > 1 {
+		return snowflakes[chosen-2], answer.Bytes()
+	}
+	// An answer buffered just as the wait ended was reported to its proxy
+	// as delivered, so take it.
+	for _, snowflake := range snowflakes {
+		select {
+		case answer := <-snowflake.answerChannel:
+			return snowflake, answer
+		default:
+		}
+	}
+	return nil, nil
+}
+
+// Returns the fraction of client offers to shed for the current client
+// roundtrip estimate: none up to shedLatency, rising linearly to
+// maxShedProbability.
+func (ctx *BrokerContext) shedProbability() float64 {
+	if ctx.shedLatency <= 0 {
+		return 0
+	}
+	ctx.metrics.lock.Lock()
+	estimate := ctx.metrics.clientRoundtripEstimate
+	ctx.metrics.lock.Unlock()
+	if estimate <= ctx.shedLatency {
+		return 0
+	}
+	return math.Min(float64(estimate-ctx.shedLatency)/float64(ctx.shedLatency), maxShedProbability)
 }
 
 /*
@@ -252,76 +1055,367 @@ the HTTP response back to the client.
 func clientOffers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 	var err error
 
+	// Every offer counts towards the rate of client arrivals, even if it is
+	// turned away, since it shows demand for proxies.
+	ctx.clientArrivals.arrive()
+
+	// Until there have first been enough proxies, have clients come back
+	// later rather than be denied.
+	if ctx.minProxiesBeforeServing > 0 && atomic.LoadInt32(&ctx.warmedUp) == 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(warmUpRetryAfter/time.Second)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// Turn the client away rather than wait if too many offers are already
+	// in flight, so that a flood of offers can't pile up goroutines.
+	if ctx.inflightClients != nil {
+		select {
+		case ctx.inflightClients <- struct{}{}:
+			defer func() { <-ctx.inflightClients }()
+		default:
+			ctx.metrics.promMetrics.ClientInflightRejectedTotal.Inc()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// Identify the client by a hash of its IP address, which is not kept,
+	// and turn it away if it is making offers too fast.
+	clientID := ctx.clientIDs.requestID(r)
+	if clientID != "" && !ctx.clientIDs.allow(clientID) {
+		ctx.metrics.promMetrics.ClientRateLimitedTotal.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(clientRateWindow/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	// Shed clients early while matches are slow, rather than have them
+	// queue up only to time out.
+	if p := ctx.shedProbability(); p > 0 && rand.Float64() < p {
+		ctx.metrics.promMetrics.ClientShedTotal.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(shedRetryAfter/time.Second)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	startTime := time.Now()
-	offer := &ClientOffer{}
-	offer.sdp, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	matchContext, cancel := ctx.matchContext(r)
+	defer cancel()
+	offer := &ClientOffer{received: startTime, context: matchContext}
+	offer.sdp, err = readRequestBody(w, r)
 	if nil != err {
 		log.Println("Invalid data.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "client", "reason": "unreadable"}).Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	offer.natType = r.Header.Get("Snowflake-NAT-Type")
-	if offer.natType == "" {
-		offer.natType = NATUnknown
+	// An offer in an envelope is passed on without looking inside.
+	offer.encoding = r.Header.Get("Snowflake-Offer-Encoding")
+	if offer.encoding != "" && !validEncodingTag(offer.encoding) {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "client", "reason": "invalid_encoding"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	// Only hand out known restricted snowflakes to unrestricted clients
-	var snowflakeHeap *SnowflakeHeap
-	if offer.natType == NATUnrestricted {
-		snowflakeHeap = ctx.restrictedSnowflakes
-	} else {
-		snowflakeHeap = ctx.snowflakes
+	if ctx.requireSDPFingerprint && offer.encoding == "" && !hasSDPFingerprint(offer.sdp) {
+		log.Println("Client offer has no DTLS fingerprint or media section.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "client", "reason": "no_fingerprint"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	// Immediately fail if there are no snowflakes available.
+	ctx.shadowClientOffer(r)
+
+	natHeader := r.Header.Get("Snowflake-NAT-Type")
+	offer.natType = clientNATType(natHeader)
+	if offer.natType == NATUnknown {
+		// Count how many clients aren't detecting their NAT type, to be
+		// told apart from those whose detection was inconclusive.
+		declared := "invalid"
+		switch strings.ToLower(strings.TrimSpace(natHeader)) {
+		case "":
+			declared = "missing"
+		case NATUnknown:
+			declared = NATUnknown
+		}
+		ctx.metrics.promMetrics.ClientUnknownNATTotal.With(prometheus.Labels{"header": declared}).Inc()
+	}
+	// Whether the client reached us directly over TLS, or in the clear, as
+	// through a domain front terminating TLS in front of the broker.
+	transport := "plain"
+	if r.TLS != nil {
+		transport = "tls"
+	}
+	clientTimeout := ctx.requestClientTimeout(r)
+	// Unless the client asked for a timeout, it depends on the NAT type of
+	// the snowflake matched, which is not known yet.
+	askedTimeout := r.Header.Get("Snowflake-Client-Timeout") != ""
+
+	// Reject a retried offer while the client's first is still in flight,
+	// rather than match both with a proxy. Session ids are scoped to the
+	// client, so that one client can't block another's by reusing its id.
+	if sessionID := r.Header.Get("X-Session-ID"); sessionID != "" {
+		if clientID != "" {
+			sessionID = clientID + "/" + sessionID
+		}
+		sessionTimeout := clientTimeout
+		if !askedTimeout {
+			for _, timeout := range ctx.clientTimeoutByNAT {
+				if timeout > sessionTimeout {
+					sessionTimeout = timeout
+				}
+			}
+		}
+		if !ctx.claimClientSession(sessionID, sessionTimeout) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		defer ctx.releaseClientSession(sessionID)
+	}
+
+	// Resolve the client's country for per-country metrics.
+	clientCountry := "??"
+	if remoteIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ctx.metrics.lock.Lock()
+		if country, ok := ctx.metrics.GetCountry(remoteIP); ok {
+			clientCountry = country
+		}
+		ctx.metrics.lock.Unlock()
+	}
+
+	snowflakeHeap := ctx.clientHeap(offer.natType)
+
+	// Find the most available snowflake proxy (or the next one in turn when
+	// matching round-robin), preferring the requested proxy type if any. It is
+	// taken under the same lock as the heap is checked, so that a snowflake
+	// timing out in between cannot leave nothing to take. If there are no
+	// snowflakes available, wait in the client queue for one if enabled and
+	// not full, likewise joining it under the lock so that a snowflake arriving
+	// in between is not missed.
+	preference := r.Header.Get("Snowflake-Proxy-Type-Preference")
+	region := ctx.clientRegion(r)
+	var snowflake *Snowflake
+	// Further snowflakes sent the offer at the same time, in case the first
+	// does not answer.
+	var fallbacks []*Snowflake
+	var waiting *waitingClient
 	ctx.snowflakeLock.Lock()
-	numSnowflakes := snowflakeHeap.Len()
+	// Clients asking for priority are matched with a tiered proxy if one is
+	// available, and with the general pool otherwise.
+	if r.Header.Get("Snowflake-Priority") == "high" {
+		if priorityHeap := ctx.priorityHeap(snowflakeHeap); priorityHeap.Len() > 0 {
+			snowflakeHeap = priorityHeap
+		}
+	}
+	// As a last resort, try a restricted snowflake for a client that is not
+	// unrestricted: the connection may well fail, but the client would
+	// otherwise be denied. This is preferred to waiting in the queue for an
+	// unrestricted snowflake that may never come.
+	restrictedFallback := false
+	if ctx.allowRestrictedFallback && offer.natType != NATUnrestricted &&
+		snowflakeHeap.Len() == 0 && ctx.restrictedSnowflakes.Len() > 0 {
+		snowflakeHeap = ctx.restrictedSnowflakes
+		restrictedFallback = true
+	}
+	if snowflakeHeap.Len() > 0 {
+		snowflake = ctx.popSnowflake(snowflakeHeap, preference, region)
+		if snowflake == nil {
+			log.Println("Client: snowflake heap emptied while matching.")
+			ctx.metrics.promMetrics.ClientEmptyHeapTotal.Inc()
+		} else {
+			reasons := ctx.matchReasons(snowflake, preference, region)
+			if restrictedFallback {
+				reasons = append(reasons, "restricted_fallback")
+			}
+			ctx.logMatch(offer.natType, snowflakeHeap, snowflake, reasons)
+		}
+		for len(fallbacks) < ctx.clientFanout-1 && snowflakeHeap.Len() > 0 {
+			fallback := ctx.popSnowflake(snowflakeHeap, preference, region)
+			ctx.logMatch(offer.natType, snowflakeHeap, fallback, append(ctx.matchReasons(fallback, preference, region), "fanout"))
+			fallbacks = append(fallbacks, fallback)
+		}
+	} else if ctx.clientQueueWait > 0 && !ctx.Draining() {
+		// No new snowflakes arrive while draining, so there is no point
+		// waiting.
+		queue := ctx.clientQueue(snowflakeHeap)
+		waiting = newWaitingClient(len(queue) + 1)
+		waiting.natType = offer.natType
+		select {
+		case queue <- waiting:
+		default:
+			waiting = nil
+		}
+	}
 	ctx.snowflakeLock.Unlock()
-	if numSnowflakes <= 0 {
+	if waiting != nil {
+		snowflake = waiting.wait(ctx.clientQueueWait, offer.context.Done())
+	}
+
+	// Release the snowflakes at once if the client has disconnected or the
+	// match deadline has passed.
+	if snowflake != nil && offer.context.Err() != nil {
+		snowflakes := append([]*Snowflake{snowflake}, fallbacks...)
+		for _, snowflake := range snowflakes {
+			close(snowflake.offerChannel)
+		}
+		ctx.forgetSnowflakes(snowflakes)
+		snowflake = nil
+		if offer.context.Err() == context.Canceled {
+			log.Println("Client: disconnected before being matched.")
+			return
+		}
+	}
+
+	// Don't waste the snowflakes on an offer gone stale: send them back to
+	// poll again, and deny the client.
+	if snowflake != nil && ctx.maxOfferAge > 0 && time.Since(offer.received) > ctx.maxOfferAge {
+		log.Println("Client: offer too old to match.")
+		snowflakes := append([]*Snowflake{snowflake}, fallbacks...)
+		for _, snowflake := range snowflakes {
+			close(snowflake.offerChannel)
+		}
+		ctx.forgetSnowflakes(snowflakes)
+		snowflake = nil
+	}
+
+	// Fail if there are still no snowflakes available.
+	if snowflake == nil {
 		ctx.metrics.lock.Lock()
 		ctx.metrics.clientDeniedCount++
-		ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "status": "denied"}).Inc()
+		ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "proxy_nat": proxyNATNone, "status": "denied", "transport": transport}).Inc()
+		ctx.metrics.promMetrics.ClientDeniedByCountry.With(prometheus.Labels{"cc": clientCountry}).Inc()
+		ctx.metrics.promMetrics.ClientMatchTotal.With(prometheus.Labels{"cc": clientCountry, "status": "denied"}).Inc()
 		if offer.natType == NATUnrestricted {
 			ctx.metrics.clientUnrestrictedDeniedCount++
 		} else {
 			ctx.metrics.clientRestrictedDeniedCount++
 		}
 		ctx.metrics.lock.Unlock()
-		w.WriteHeader(http.StatusServiceUnavailable)
+		ctx.eventLog.record(matchEvent{Event: eventClientOffer, ClientNAT: offer.natType, Outcome: "denied"})
+		ctx.writeDenied(w)
 		return
 	}
-	// Otherwise, find the most available snowflake proxy, and pass the offer to it.
+	// Otherwise pass the offer to the snowflakes.
 	// Delete must be deferred in order to correctly process answer request later.
+	snowflakes := append([]*Snowflake{snowflake}, fallbacks...)
+	offerSent := time.Now()
 	ctx.snowflakeLock.Lock()
-	snowflake := heap.Pop(snowflakeHeap).(*Snowflake)
+	for _, snowflake := range snowflakes {
+		snowflake.offerSent = offerSent
+		snowflake.matchDone = offer.context.Done()
+	}
 	ctx.snowflakeLock.Unlock()
-	snowflake.offerChannel <- offer
+	for _, snowflake := range snowflakes {
+		snowflake.offerChannel <- offer
+	}
+	if !askedTimeout {
+		clientTimeout = 0
+		for _, snowflake := range snowflakes {
+			if timeout := ctx.natClientTimeout(snowflake.natType); timeout > clientTimeout {
+				clientTimeout = timeout
+			}
+		}
+	}
 
-	// Wait for the answer to be returned on the channel or timeout.
-	select {
-	case answer := <-snowflake.answerChannel:
+	// Wait for the first answer to be returned on a channel or timeout.
+	answerer, answer := ctx.waitForAnswer(snowflakes, clientTimeout, offer.context.Done())
+	if answerer != nil {
+		ctx.natRedetection.succeed(answerer.id)
+		ctx.proxyQuarantine.succeed(answerer.id)
+		ctx.eventLog.record(matchEvent{
+			Event:     eventClientOffer,
+			ClientNAT: offer.natType,
+			ProxyNAT:  answerer.natType,
+			ProxyType: answerer.proxyType,
+			Outcome:   "matched",
+		})
 		ctx.metrics.lock.Lock()
 		ctx.metrics.clientProxyMatchCount++
-		ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "status": "matched"}).Inc()
+		ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "proxy_nat": answerer.natType, "status": "matched", "transport": transport}).Inc()
+		if restrictedFallback {
+			ctx.metrics.promMetrics.ClientRestrictedFallbackTotal.With(prometheus.Labels{"status": "matched"}).Inc()
+		}
+		ctx.metrics.promMetrics.ClientMatchTotal.With(prometheus.Labels{"cc": clientCountry, "status": "matched"}).Inc()
+		ctx.metrics.UpdateClientRoundtrip(time.Since(startTime))
 		ctx.metrics.lock.Unlock()
-		if _, err := w.Write(answer); err != nil {
+		if waiting != nil {
+			w.Header().Set("Snowflake-Queue-Position", strconv.Itoa(waiting.position))
+		}
+		ctx.snowflakeLock.Lock()
+		answerEncoding := answerer.answerEncoding
+		ctx.snowflakeLock.Unlock()
+		if answerEncoding != "" {
+			w.Header().Set("Snowflake-Answer-Encoding", answerEncoding)
+		}
+		if err := writeFully(w, answer); err != nil {
 			log.Printf("unable to write answer with error: %v", err)
+			ctx.metrics.promMetrics.ResponseWriteErrorTotal.With(prometheus.Labels{"endpoint": "client"}).Inc()
+		}
+	} else if offer.context.Err() == context.Canceled {
+		// There is no one to respond to, and the proxies' answers are
+		// refused from now on.
+		log.Println("Client: disconnected while waiting for an answer.")
+		ctx.metrics.lock.Lock()
+		ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "proxy_nat": snowflake.natType, "status": "canceled", "transport": transport}).Inc()
+		if restrictedFallback {
+			ctx.metrics.promMetrics.ClientRestrictedFallbackTotal.With(prometheus.Labels{"status": "canceled"}).Inc()
 		}
-		// Initial tracking of elapsed time.
-		ctx.metrics.clientRoundtripEstimate = time.Since(startTime) /
-			time.Millisecond
-	case <-time.After(time.Second * ClientTimeout):
+		ctx.metrics.lock.Unlock()
+	} else {
 		log.Println("Client: Timed out.")
+		ctx.eventLog.record(matchEvent{
+			Event:     eventClientOffer,
+			ClientNAT: offer.natType,
+			ProxyNAT:  snowflake.natType,
+			ProxyType: snowflake.proxyType,
+			Outcome:   "timeout",
+		})
+		for _, snowflake := range snowflakes {
+			ctx.metrics.promMetrics.ProxyAnswerLatency.With(prometheus.Labels{"status": "timeout"}).Observe(time.Since(offerSent).Seconds())
+			ctx.natRedetection.fail(snowflake.id, snowflake.natType)
+			// Late answers are counted here, when the client times out,
+			// rather than when they arrive for an id no longer known, which
+			// anyone could claim.
+			if ctx.proxyQuarantine.fail(snowflake.id) {
+				log.Println("Proxy quarantined for failing to answer.")
+				ctx.metrics.promMetrics.ProxyQuarantinedTotal.Inc()
+			}
+		}
+		ctx.metrics.lock.Lock()
+		ctx.metrics.promMetrics.ClientPollTotal.With(prometheus.Labels{"nat": offer.natType, "proxy_nat": snowflake.natType, "status": "timeout", "transport": transport}).Inc()
+		if restrictedFallback {
+			ctx.metrics.promMetrics.ClientRestrictedFallbackTotal.With(prometheus.Labels{"status": "timeout"}).Inc()
+		}
+		ctx.metrics.promMetrics.ClientMatchTotal.With(prometheus.Labels{"cc": clientCountry, "status": "timeout"}).Inc()
+		ctx.metrics.lock.Unlock()
 		w.WriteHeader(http.StatusGatewayTimeout)
 		if _, err := w.Write([]byte("timed out waiting for answer!")); err != nil {
 			log.Printf("unable to write timeout error, failed with error: %v", err)
 		}
 	}
 
+	// The snowflakes are forgotten whether or not they answered in time. They
+	// are not put back in the heap: their proxies' polls have already been
+	// answered with this client's offer, so the proxies are no longer waiting
+	// for another one, and they register afresh when they next poll.
+	// Forgetting the ids makes a late answer, or one from a fallback that lost
+	// out, get the "client gone" response, which sends the proxy back to poll.
+	ctx.forgetSnowflakes(snowflakes)
+}
+
+// Forgets snowflakes taken from the heap for a client, once their proxies'
+// polls have been answered.
+func (ctx *BrokerContext) forgetSnowflakes(snowflakes []*Snowflake) {
 	ctx.snowflakeLock.Lock()
-	ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
-	delete(ctx.idToSnowflake, snowflake.id)
+	for _, snowflake := range snowflakes {
+		ctx.metrics.promMetrics.AvailableProxies.With(prometheus.Labels{"nat": snowflake.natType, "type": snowflake.proxyType}).Dec()
+		// The proxy may have registered again with the same id in the meantime.
+		if ctx.idToSnowflake[snowflake.id] == snowflake {
+			delete(ctx.idToSnowflake, snowflake.id)
+		}
+	}
 	ctx.snowflakeLock.Unlock()
 }
 
@@ -335,24 +1429,68 @@ func proxyAnswers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
 	if nil != err || nil == body || len(body) <= 0 {
 		log.Println("Invalid data.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "answer", "reason": "unreadable"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	message, err := messages.DecodeAnswerRequestMessage(body)
+	if err != nil {
+		log.Printf("Proxy answer could not be decoded: %v", err)
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "answer", "reason": "undecodable"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	answer, id := message.Answer, message.Sid
+	if message.Encoding != "" && !validEncodingTag(message.Encoding) {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "answer", "reason": "invalid_encoding"}).Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	answer, id, err := messages.DecodeAnswerRequest(body)
-	if err != nil || answer == "" {
+	// Don't pass on an answer the client could not use, unless it is in an
+	// envelope the broker can't look inside.
+	if ctx.requireSDPFingerprint && message.Encoding == "" && !hasSDPFingerprint([]byte(answer)) {
+		log.Println("Proxy answer has no DTLS fingerprint or media section.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "answer", "reason": "no_fingerprint"}).Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	var success = true
+	var offerSent time.Time
 	ctx.snowflakeLock.Lock()
 	snowflake, ok := ctx.idToSnowflake[id]
+	if ok && nil != snowflake {
+		offerSent = snowflake.offerSent
+		snowflake.answerEncoding = message.Encoding
+	}
 	ctx.snowflakeLock.Unlock()
 	if !ok || nil == snowflake {
 		// The snowflake took too long to respond with an answer, so its client
 		// disappeared / the snowflake is no longer recognized by the Broker.
+		log.Println("Proxy answer for an unknown id, its client is gone.")
+		ctx.metrics.promMetrics.AnswerUnknownIDTotal.Inc()
+		ctx.eventLog.record(matchEvent{Event: eventProxyAnswer, Outcome: "unknown_id"})
 		success = false
+	} else {
+		latency := time.Since(offerSent)
+		success = ctx.deliverAnswer(snowflake, []byte(answer))
+		outcome := "delivered"
+		if success {
+			ctx.pendingAcks.add(id)
+		} else {
+			outcome = "client_gone"
+		}
+		ctx.eventLog.record(matchEvent{
+			Event:     eventProxyAnswer,
+			ProxyNAT:  snowflake.natType,
+			ProxyType: snowflake.proxyType,
+			Outcome:   outcome,
+		})
+		if success && !offerSent.IsZero() {
+			ctx.metrics.promMetrics.ProxyAnswerLatency.With(prometheus.Labels{"status": "answered"}).Observe(latency.Seconds())
+		}
 	}
 	b, err := messages.EncodeAnswerResponse(success)
 	if err != nil {
@@ -361,29 +1499,75 @@ func proxyAnswers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Write(b)
+}
+
+// Hands an answer to the client waiting on the snowflake, retrying for a
+// little while in case the client is not yet ready to receive it, but for no
+// longer than answerDeliverTimeout in all. Returns false if the client did not
+// take the answer, for instance because it timed out.
+func (ctx *BrokerContext) deliverAnswer(snowflake *Snowflake, answer []byte) bool {
+	// Buffer the answer if there is room, provided the client is still
+	// waiting: it checks for buffered answers under the same lock as it
+	// stops.
+	ctx.snowflakeLock.Lock()
+	if snowflake.clientGone {
+		ctx.snowflakeLock.Unlock()
+		return false
+	}
+	select {
+	case snowflake.answerChannel <- answer:
+		ctx.snowflakeLock.Unlock()
+		return true
+	default:
+	}
+	matchDone := snowflake.matchDone
+	ctx.snowflakeLock.Unlock()
 
-	if success {
-		snowflake.answerChannel <- []byte(answer)
+	deadline := time.NewTimer(ctx.answerDeliverTimeout)
+	defer deadline.Stop()
+	for attempt := 0; attempt <= ctx.answerRetries; attempt++ {
+		if attempt > 0 {
+			ctx.metrics.promMetrics.AnswerRetryTotal.Inc()
+		}
+		timer := time.NewTimer(answerRetryInterval)
+		select {
+		case snowflake.answerChannel <- answer:
+			timer.Stop()
+			return true
+		case <-timer.C:
+		case <-deadline.C:
+			timer.Stop()
+			ctx.metrics.promMetrics.AnswerDeliverTimeoutTotal.Inc()
+			return false
+		case <-matchDone:
+			timer.Stop()
+			return false
+		}
 	}
+	return false
+}
 
+// Proxy types listed first by the debug page, with the names they are listed
+// under. Other types are listed after them by their own names.
+var debugProxyTypes = []struct {
+	proxyType string
+	name      string
+}{
+	{"standalone", "standalone"},
+	{"badge", "browser"},
+	{"webext", "webext"},
 }
 
 func debugHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 
-	var webexts, browsers, standalones, unknowns int
+	proxyTypes := make(map[string]int)
+	regions := make(map[string]int)
 	var natRestricted, natUnrestricted, natUnknown int
 	ctx.snowflakeLock.Lock()
 	s := fmt.Sprintf("current snowflakes available: %d\n", len(ctx.idToSnowflake))
 	for _, snowflake := range ctx.idToSnowflake {
-		if snowflake.proxyType == "badge" {
-			browsers++
-		} else if snowflake.proxyType == "webext" {
-			webexts++
-		} else if snowflake.proxyType == "standalone" {
-			standalones++
-		} else {
-			unknowns++
-		}
+		proxyTypes[snowflake.proxyType]++
+		regions[snowflake.region]++
 
 		switch snowflake.natType {
 		case NATRestricted:
@@ -396,15 +1580,44 @@ func debugHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 
 	}
 	ctx.snowflakeLock.Unlock()
-	s += fmt.Sprintf("\tstandalone proxies: %d", standalones)
-	s += fmt.Sprintf("\n\tbrowser proxies: %d", browsers)
-	s += fmt.Sprintf("\n\twebext proxies: %d", webexts)
+	for i, known := range debugProxyTypes {
+		if i > 0 {
+			s += "\n"
+		}
+		s += fmt.Sprintf("\t%s proxies: %d", known.name, proxyTypes[known.proxyType])
+		delete(proxyTypes, known.proxyType)
+	}
+	// Proxies that don't report a type are counted as unknown.
+	unknowns := proxyTypes[""] + proxyTypes["unknown"]
+	delete(proxyTypes, "")
+	delete(proxyTypes, "unknown")
+	var others []string
+	for proxyType := range proxyTypes {
+		others = append(others, proxyType)
+	}
+	sort.Strings(others)
+	for _, proxyType := range others {
+		s += fmt.Sprintf("\n\t%s proxies: %d", proxyType, proxyTypes[proxyType])
+	}
 	s += fmt.Sprintf("\n\tunknown proxies: %d", unknowns)
 
 	s += fmt.Sprintf("\nNAT Types available:")
 	s += fmt.Sprintf("\n\trestricted: %d", natRestricted)
 	s += fmt.Sprintf("\n\tunrestricted: %d", natUnrestricted)
 	s += fmt.Sprintf("\n\tunknown: %d", natUnknown)
+	// Regions are only broken down if proxies may declare any.
+	if len(ctx.allowedRegions) > 0 {
+		var allowed []string
+		for region := range ctx.allowedRegions {
+			allowed = append(allowed, region)
+		}
+		sort.Strings(allowed)
+		s += "\nRegions available:"
+		for _, region := range allowed {
+			s += fmt.Sprintf("\n\t%s: %d", region, regions[region])
+		}
+		s += fmt.Sprintf("\n\t%s: %d", noRegion, regions[""])
+	}
 	if _, err := w.Write([]byte(s)); err != nil {
 		log.Printf("writing proxy information returned error: %v ", err)
 	}
@@ -417,6 +1630,21 @@ func robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serves page at the root path only, so that the broker looks like any other
+// web server to casual probing. Other unknown paths are still not found.
+func decoyHandler(page []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(page); err != nil {
+			log.Printf("decoyHandler unable to write, with this error: %v", err)
+		}
+	}
+}
+
 func metricsHandler(metricsFilename string, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
@@ -424,38 +1652,413 @@ func metricsHandler(metricsFilename string, w http.ResponseWriter, r *http.Reque
 		http.NotFound(w, r)
 		return
 	}
+	// Open the file on every request so that a rotated metrics file is picked
+	// up rather than serving the old inode.
 	metricsFile, err := os.OpenFile(metricsFilename, os.O_RDONLY, 0644)
-	if err != nil {
-		log.Println("Error opening metrics file for reading")
+	if os.IsNotExist(err) {
+		log.Println("Metrics file does not exist")
 		http.NotFound(w, r)
 		return
+	} else if os.IsPermission(err) {
+		log.Println("Permission denied opening metrics file for reading")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println("Error opening metrics file for reading")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer metricsFile.Close()
+
+	info, err := metricsFile.Stat()
+	if err != nil {
+		log.Printf("stat of metricsFile returned error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Only serve the tail of the file, starting at the first complete line.
+	size := info.Size()
+	offset := int64(0)
+	if size > metricsTailLimit {
+		offset = size - metricsTailLimit
+	}
+	if _, err := metricsFile.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("seeking metricsFile returned error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b := make([]byte, size-offset)
+	n, err := io.ReadFull(metricsFile, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		log.Printf("reading metricsFile returned error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b = b[:n]
+	if offset > 0 {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
 	}
 
-	if _, err := io.Copy(w, metricsFile); err != nil {
-		log.Printf("copying metricsFile returned error: %v", err)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if _, err := w.Write(b); err != nil {
+		log.Printf("writing metricsFile returned error: %v", err)
 	}
 }
 
-func RunBroker(addr string) {
-	var acmeEmail string
-	var acmeHostnamesCommas string
-	var acmeCertCacheDir string
-	var geoipDatabase string
-	var geoip6Database string
-	var disableTLS bool
-	var certFilename, keyFilename string
-	var disableGeoip bool
-	var metricsFilename string
-	var unsafeLogging bool
-
-	disableTLS = true
-	disableGeoip = true
-	unsafeLogging = true
+// Returns the mux of the public listener. /debug is registered only if enabled,
+// since it shows how the pool is made up, and the admin endpoints only if there
+// is an admin token to guard them.
+func newServeMux(ctx *BrokerContext, cfg Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", robotsTxtHandler)
+	mux.HandleFunc("/version", versionHandler)
+	if ctx.decoyPage != nil {
+		mux.Handle("/", decoyHandler(ctx.decoyPage))
+	}
+
+	mux.Handle("/proxy", SnowflakeHandler{ctx, proxyPolls})
+	mux.Handle("/proxy/deregister", SnowflakeHandler{ctx, proxyDeregister})
+	mux.Handle("/proxy/ack", SnowflakeHandler{ctx, proxyAck})
+	mux.Handle("/client", SnowflakeHandler{ctx, clientOffers})
+	mux.Handle("/client/ws", SnowflakeHandler{ctx, clientWebSocket})
+	mux.Handle("/answer", SnowflakeHandler{ctx, proxyAnswers})
+	mux.Handle("/status", SnowflakeHandler{ctx, statusHandler})
+	if cfg.EnableDebugEndpoint {
+		mux.Handle("/debug", SnowflakeHandler{ctx, debugHandler})
+	}
+	var metrics, prometheusMetrics http.Handler
+	metrics = compressedHandler(MetricsHandler{cfg.MetricsFilename, metricsHandler})
+	prometheusMetrics = compressedHandler(filteredMetricsHandler(ctx.metrics.promMetrics.registry))
+	if ctx.metricsAuth != nil {
+		metrics = NewBasicAuthHandler(metrics, ctx.metricsAuth, "metrics")
+		prometheusMetrics = NewBasicAuthHandler(prometheusMetrics, ctx.metricsAuth, "metrics")
+	}
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/prometheus", prometheusMetrics)
+	if ctx.adminToken != "" {
+		mux.Handle("/admin/drain", AdminHandler{ctx, drainHandler})
+		mux.Handle("/admin/undrain", AdminHandler{ctx, undrainHandler})
+		mux.Handle("/admin/config", AdminHandler{ctx, configHandler})
+		mux.Handle("/admin/heap", AdminHandler{ctx, heapHandler})
+	}
+	return mux
+}
+
+// Options for Run. Zero values of the timeouts, CORSOrigin, CORSMaxAge, and
+// MatchStrategy select the defaults.
+type Config struct {
+	Addr string
+
+	// TLS is set up from exactly one of AcmeHostnames, CertFilename and
+	// KeyFilename, or DisableTLS.
+	AcmeEmail        string
+	AcmeHostnames    []string
+	AcmeCertCacheDir string
+	CertFilename     string
+	KeyFilename      string
+	DisableTLS       bool
+	EnableH2C        bool // also serve HTTP/2 over cleartext; requires DisableTLS
+	TLSMinVersion    string
+	TLSCipherSuites  string
+	// Whether to fetch the ACME certificates at startup rather than on the
+	// first handshake for each hostname.
+	AcmeWarmCache bool
+
+	DisableGeoip   bool
+	GeoipDatabase  string
+	Geoip6Database string
+	// Base URL from which to download updated geoip databases, as "geoip"
+	// and "geoip6", every GeoipRefreshInterval, through GeoipRefreshProxy if
+	// set and the environment's HTTP(S)_PROXY otherwise.
+	GeoipRefreshURL      string
+	GeoipRefreshInterval time.Duration
+	GeoipRefreshProxy    string
+
+	// File of CIDR ranges whose requests are rejected, reloaded on SIGHUP.
+	BlocklistFile string
+
+	MetricsFilename   string
+	MetricsFormat     string
+	AccessLogFilename string
+	UnsafeLogging     bool
+	LogLevel          string
+	// Path of a newline-delimited JSON log of match events, if not empty,
+	// and the fraction of events in (0, 1] written to it; zero means all.
+	EventLogFilename string
+	EventSampleRate  float64
+
+	ClientTimeout time.Duration
+	// Client timeouts in place of ClientTimeout when matched with a
+	// restricted or unrestricted snowflake, if positive.
+	ClientTimeoutRestricted   time.Duration
+	ClientTimeoutUnrestricted time.Duration
+	// Longest timeout clients may ask for with the Snowflake-Client-Timeout
+	// header.
+	MaxClientTimeout time.Duration
+	ProxyTimeout     time.Duration
+	// Longest wait proxies may ask for with the Wait field of their polls.
+	MaxProxyTimeout time.Duration
+	ClientQueueWait time.Duration
+	// Oldest a client offer may be when matched, if positive.
+	MaxOfferAge time.Duration
+	// Longest the whole match of a client may take, from its offer arriving
+	// to its proxy's answer, if positive.
+	MatchDeadline time.Duration
+	// Bounds of a proxy timeout adapting to the rate at which clients arrive,
+	// shorter while they are plentiful, in place of ProxyTimeout if the
+	// minimum is positive. The maximum is ProxyTimeout if zero.
+	MinAdaptiveProxyTimeout time.Duration
+	MaxAdaptiveProxyTimeout time.Duration
+	// Whether to reject client offers and proxy answers whose SDP has no
+	// DTLS fingerprint or no media section.
+	RequireSDPFingerprint bool
+	// Maximum number of proxy polls waiting for a client at once, beyond
+	// which polls are turned away; zero means no limit.
+	BrokerWorkers int
+	// Maximum number of client offers handled at once, beyond which clients
+	// are turned away; zero means no limit.
+	MaxInflightClients int
+	// Most offers each client, told apart by a hash of its IP address, may
+	// make a minute; zero means no limit.
+	MaxClientOffersPerMinute int
+	// Client roundtrip estimate above which client offers are shed; zero
+	// means never.
+	ShedLatency time.Duration
+	// Number of proxies that must first be available at once before client
+	// offers are accepted; until then clients are asked to retry later.
+	MinProxiesBeforeServing int
+	// Most proxies tracked at once, beyond which the oldest are forgotten;
+	// zero means no limit.
+	MaxTrackedProxies int
+	// How often to audit the snowflake heaps against the proxies tracked,
+	// repairing any inconsistencies; zero means never.
+	AuditInterval time.Duration
+	// Number of times to retry handing an answer to its client; negative
+	// means none and zero the default.
+	AnswerRetries int
+	// Longest the attempts to hand an answer to its client may take in all.
+	AnswerDeliverTimeout time.Duration
+	// Capacity of each proxy's offer and answer channels; negative means
+	// unbuffered and zero the default.
+	ChannelBuffer int
+	// Failed matches in a row after which a proxy's poll asks it to detect
+	// its NAT type again; negative means never and zero the default.
+	NATRedetectAfter int
+	// Fraction of ProxyTimeout, in [0, 1), by which to randomize each
+	// proxy's timeout.
+	TimeoutJitter float64
+
+	CORSOrigin string
+	// How long browsers may cache CORS preflight responses.
+	CORSMaxAge time.Duration
+	// Origins allowed to make cross-origin requests, overriding CORSOrigin
+	// if not empty.
+	CORSAllowedOrigins []string
+	// URL of a sibling broker to point clients at when no snowflake is
+	// available, if not empty.
+	FallbackBrokerURL string
+	MatchStrategy     string
+	// Whether to prefer proxies whose connections have succeeded more often
+	// over those serving as many clients.
+	QualityMatching bool
+	// Regions or datacenters proxies may declare themselves in, by which
+	// they are counted. Proxies declaring others are counted in none.
+	ProxyRegions []string
+	// Whether to prefer, for clients asking for a region, the proxies that
+	// declared it.
+	RegionMatching bool
+	// Whether to match clients that are not unrestricted with restricted
+	// proxies, as a last resort, when no unrestricted proxy is available.
+	AllowRestrictedFallback bool
+	// URLs of STUN or TURN servers to suggest to proxies along with client
+	// offers, passed on as they are.
+	ICEServers []string
+	// URL of a broker to mirror the metadata of client offers and proxy
+	// polls to, such as a standby under test, if not empty.
+	ShadowBrokerURL string
+	// Comma-separated proxyType=weight pairs giving the relative capacities
+	// of proxy types when comparing their loads.
+	ProxyTypeWeights string
+	// Comma-separated host=pool pairs giving hosts pools of snowflakes of
+	// their own, with requests for other hosts not found. Hosts given the
+	// same pool name share it. If empty, all hosts share one pool.
+	VhostPools string
+	// Number of snowflakes to pass each client offer to at once, answering
+	// with the first answer; zero means one.
+	ClientFanout int
+	// Proxy types allowed to poll, or all of them if empty.
+	AllowedProxyTypes []string
+	// File of proxy types allowed to poll, one per line, replacing
+	// AllowedProxyTypes and reloaded on SIGHUP.
+	AllowedProxyTypesFile string
+	// How long a proxy id may keep registering after it was first seen,
+	// without limit if zero, and for how long it is then refused.
+	MaxProxyLifetime      time.Duration
+	ProxyLifetimeCooldown time.Duration
+	// Failed answers within QuarantineWindow after which a proxy id is
+	// refused for QuarantineCooldown, or never if zero.
+	QuarantineAfter    int
+	QuarantineWindow   time.Duration
+	QuarantineCooldown time.Duration
+	// Time since its last poll after which a proxy is counted as stale, or
+	// zero not to count stale proxies.
+	ProxyStaleAfter time.Duration
+
+	// File containing the bearer token for the /admin/ endpoints, which are
+	// disabled on the main listener if unset.
+	AdminTokenFile string
+	// Credentials of the form user:passhash, with the bcrypt hash of the
+	// password, required by the metrics endpoints if not empty.
+	MetricsAuth string
+	// Address of a separate TLS listener for the /admin/ endpoints, which
+	// requires a client certificate issued by a CA in AdminClientCAFile, and
+	// the admin token too if one is set.
+	AdminAddr         string
+	AdminCertFilename string
+	AdminKeyFilename  string
+	AdminClientCAFile string
+
+	// File of "tier token" lines, giving the bearer tokens with which trusted
+	// proxies may poll with a tier.
+	ProxyTiersFile string
+
+	// Whether to serve /debug, which shows how the pool is made up.
+	EnableDebugEndpoint bool
+	// HTML file served at the root path, if not empty.
+	DecoyPage string
+
+	// Run a synthetic offer/answer round trip and return instead of serving.
+	SelfTest bool
+}
+
+// Runs the broker with the given options until its listener fails, returning
+// the error that stopped it. With cfg.SelfTest, returns the result of the
+// self-test instead.
+func Run(cfg Config) error {
+	v := buildVersion()
+	log.Printf("Snowflake broker version %s, commit %s, built with %s", v.Version, v.Commit, v.Go)
+
+	if cfg.MatchStrategy == "" {
+		cfg.MatchStrategy = MatchLeastLoaded
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = LogLevelInfo
+	}
+	if cfg.LogLevel != LogLevelInfo && cfg.LogLevel != LogLevelDebug {
+		return fmt.Errorf("unknown log level %q", cfg.LogLevel)
+	}
+	if cfg.MatchStrategy != MatchLeastLoaded && cfg.MatchStrategy != MatchRoundRobin {
+		return fmt.Errorf("unknown match strategy %q", cfg.MatchStrategy)
+	}
+	vhostPools, err := parseVhostPools(cfg.VhostPools)
+	if err != nil {
+		return err
+	}
+	proxyTypeWeights, err := parseProxyTypeWeights(cfg.ProxyTypeWeights)
+	if err != nil {
+		return err
+	}
+	if cfg.EnableH2C && !cfg.DisableTLS {
+		return fmt.Errorf("h2c can only be enabled with TLS disabled")
+	}
+	if cfg.MaxClientTimeout != 0 && cfg.MaxClientTimeout < minClientTimeout {
+		return fmt.Errorf("max client timeout %v is less than %v", cfg.MaxClientTimeout, minClientTimeout)
+	}
+	if cfg.MaxProxyTimeout != 0 && cfg.MaxProxyTimeout < minProxyTimeout {
+		return fmt.Errorf("max proxy timeout %v is less than %v", cfg.MaxProxyTimeout, minProxyTimeout)
+	}
+	if cfg.MatchDeadline < 0 {
+		return fmt.Errorf("match deadline %v is negative", cfg.MatchDeadline)
+	}
+	if cfg.MinAdaptiveProxyTimeout < 0 || cfg.MaxAdaptiveProxyTimeout < 0 {
+		return fmt.Errorf("adaptive proxy timeout bounds %v and %v must not be negative", cfg.MinAdaptiveProxyTimeout, cfg.MaxAdaptiveProxyTimeout)
+	}
+	if cfg.MaxAdaptiveProxyTimeout > 0 && cfg.MinAdaptiveProxyTimeout > cfg.MaxAdaptiveProxyTimeout {
+		return fmt.Errorf("min adaptive proxy timeout %v is more than the max %v", cfg.MinAdaptiveProxyTimeout, cfg.MaxAdaptiveProxyTimeout)
+	}
+	if cfg.MaxProxyLifetime > 0 && cfg.ProxyLifetimeCooldown <= 0 {
+		return fmt.Errorf("proxy lifetime cooldown %v is not positive", cfg.ProxyLifetimeCooldown)
+	}
+	if cfg.QuarantineAfter < 0 {
+		return fmt.Errorf("quarantine threshold %d is negative", cfg.QuarantineAfter)
+	}
+	if cfg.QuarantineAfter > 0 && (cfg.QuarantineWindow <= 0 || cfg.QuarantineCooldown <= 0) {
+		return fmt.Errorf("quarantine window %v and cooldown %v must be positive", cfg.QuarantineWindow, cfg.QuarantineCooldown)
+	}
+	if cfg.ProxyStaleAfter < 0 {
+		return fmt.Errorf("proxy staleness threshold %v is negative", cfg.ProxyStaleAfter)
+	}
+	if cfg.FallbackBrokerURL != "" {
+		u, err := url.Parse(cfg.FallbackBrokerURL)
+		if err != nil {
+			return fmt.Errorf("invalid fallback broker url: %v", err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("fallback broker url %q is not an absolute url", cfg.FallbackBrokerURL)
+		}
+	}
+	if cfg.ShadowBrokerURL != "" {
+		u, err := url.Parse(cfg.ShadowBrokerURL)
+		if err != nil {
+			return fmt.Errorf("invalid shadow broker url: %v", err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("shadow broker url %q is not an absolute url", cfg.ShadowBrokerURL)
+		}
+	}
+	if cfg.MaxOfferAge < 0 {
+		return fmt.Errorf("max offer age %v is negative", cfg.MaxOfferAge)
+	}
+	if cfg.EventSampleRate < 0 || cfg.EventSampleRate > 1 {
+		return fmt.Errorf("event sample rate %v is not in [0, 1]", cfg.EventSampleRate)
+	}
+	if cfg.ClientFanout < 0 {
+		return fmt.Errorf("client fanout %d is negative", cfg.ClientFanout)
+	}
+	if cfg.MaxInflightClients < 0 {
+		return fmt.Errorf("max inflight clients %d is negative", cfg.MaxInflightClients)
+	}
+	if cfg.MaxClientOffersPerMinute < 0 {
+		return fmt.Errorf("max client offers per minute %d is negative", cfg.MaxClientOffersPerMinute)
+	}
+	if cfg.MinProxiesBeforeServing < 0 {
+		return fmt.Errorf("min proxies before serving %d is negative", cfg.MinProxiesBeforeServing)
+	}
+	if cfg.ShedLatency < 0 {
+		return fmt.Errorf("shed latency %v is negative", cfg.ShedLatency)
+	}
+	if cfg.AuditInterval < 0 {
+		return fmt.Errorf("audit interval %v is negative", cfg.AuditInterval)
+	}
+	if cfg.AnswerDeliverTimeout < 0 {
+		return fmt.Errorf("answer deliver timeout %v is negative", cfg.AnswerDeliverTimeout)
+	}
+	if cfg.MaxTrackedProxies < 0 {
+		return fmt.Errorf("max tracked proxies %d is negative", cfg.MaxTrackedProxies)
+	}
+	if cfg.BrokerWorkers < 0 {
+		return fmt.Errorf("broker workers %d is negative", cfg.BrokerWorkers)
+	}
+	if cfg.CORSMaxAge < 0 {
+		return fmt.Errorf("CORS max age %v is negative", cfg.CORSMaxAge)
+	}
+	if cfg.TimeoutJitter < 0 || cfg.TimeoutJitter >= 1 {
+		return fmt.Errorf("timeout jitter %v is not in [0, 1)", cfg.TimeoutJitter)
+	}
+	metricsFormatter, err := NewMetricsFormatter(cfg.MetricsFormat)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(cfg.TLSMinVersion, cfg.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
 
-	var err error
-	var metricsFile io.Writer
 	var logOutput io.Writer = os.Stderr
-	if unsafeLogging {
+	if cfg.UnsafeLogging {
 		log.SetOutput(logOutput)
 	} else {
 		// We want to send the log output through our scrubber first
@@ -464,58 +2067,342 @@ func RunBroker(addr string) {
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
 
-	if metricsFilename != "" {
-		metricsFile, err = os.OpenFile(metricsFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	var metricsFile *metricsFile
+	if cfg.MetricsFilename != "" {
+		f, err := os.OpenFile(cfg.MetricsFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 
 		if err != nil {
-			log.Fatal(err.Error())
+			return err
 		}
+		defer f.Close()
+		metricsFile = newMetricsFile(f)
 	} else {
-		metricsFile = os.Stdout
+		metricsFile = newMetricsFile(os.Stdout)
 	}
+	// Don't lose metrics if the broker stops.
+	defer func() {
+		if err := metricsFile.Sync(); err != nil {
+			log.Printf("syncing metrics file returned error: %v", err)
+		}
+	}()
 
 	metricsLogger := log.New(metricsFile, "", 0)
 
 	ctx := NewBrokerContext(metricsLogger)
+	ctx.metrics.SetFormatter(metricsFormatter)
+	if cfg.ClientTimeout > 0 {
+		ctx.clientTimeout = cfg.ClientTimeout
+	}
+	for natType, timeout := range map[string]time.Duration{
+		NATRestricted:   cfg.ClientTimeoutRestricted,
+		NATUnrestricted: cfg.ClientTimeoutUnrestricted,
+	} {
+		if timeout > 0 {
+			if ctx.clientTimeoutByNAT == nil {
+				ctx.clientTimeoutByNAT = make(map[string]time.Duration)
+			}
+			ctx.clientTimeoutByNAT[natType] = timeout
+		}
+	}
+	if cfg.ProxyTimeout > 0 {
+		ctx.proxyTimeout = cfg.ProxyTimeout
+	}
+	if cfg.MaxClientTimeout > 0 {
+		ctx.maxClientTimeout = cfg.MaxClientTimeout
+	}
+	if cfg.MaxProxyTimeout > 0 {
+		ctx.maxProxyTimeout = cfg.MaxProxyTimeout
+	}
+	ctx.matchDeadline = cfg.MatchDeadline
+	ctx.minAdaptiveProxyTimeout = cfg.MinAdaptiveProxyTimeout
+	ctx.maxAdaptiveProxyTimeout = cfg.MaxAdaptiveProxyTimeout
+	if cfg.CORSOrigin != "" {
+		ctx.corsOrigin = cfg.CORSOrigin
+	}
+	if cfg.CORSMaxAge > 0 {
+		ctx.corsMaxAge = cfg.CORSMaxAge
+	}
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		ctx.corsAllowedOrigins = make(map[string]bool)
+		for _, origin := range cfg.CORSAllowedOrigins {
+			ctx.corsAllowedOrigins[origin] = true
+		}
+	}
+	if cfg.EventLogFilename != "" {
+		f, err := os.OpenFile(cfg.EventLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sampleRate := cfg.EventSampleRate
+		if sampleRate == 0 {
+			sampleRate = 1
+		}
+		ctx.eventLog = newEventLog(f, sampleRate)
+	}
+	if cfg.LogLevel == LogLevelDebug {
+		// Scrubbed even with unsafe logging, since it is only for
+		// diagnosis.
+		ctx.matchLog = log.New(&safelog.LogScrubber{Output: logOutput}, "debug: ", log.LstdFlags|log.LUTC)
+	}
+	ctx.fallbackBrokerURL = cfg.FallbackBrokerURL
+	if cfg.ShadowBrokerURL != "" {
+		shadow, err := newShadowBroker(cfg.ShadowBrokerURL)
+		if err != nil {
+			return err
+		}
+		ctx.shadow = shadow
+	}
+	ctx.requireSDPFingerprint = cfg.RequireSDPFingerprint
+	ctx.clientQueueWait = cfg.ClientQueueWait
+	ctx.maxOfferAge = cfg.MaxOfferAge
+	if cfg.BrokerWorkers > 0 {
+		ctx.matchWorkers = make(chan struct{}, cfg.BrokerWorkers)
+	}
+	if cfg.MaxInflightClients > 0 {
+		ctx.inflightClients = make(chan struct{}, cfg.MaxInflightClients)
+	}
+	ctx.clientIDs.limit = cfg.MaxClientOffersPerMinute
+	ctx.shedLatency = cfg.ShedLatency
+	ctx.minProxiesBeforeServing = cfg.MinProxiesBeforeServing
+	ctx.maxTrackedProxies = cfg.MaxTrackedProxies
+	if cfg.AnswerRetries > 0 {
+		ctx.answerRetries = cfg.AnswerRetries
+	} else if cfg.AnswerRetries < 0 {
+		ctx.answerRetries = 0
+	}
+	if cfg.AnswerDeliverTimeout > 0 {
+		ctx.answerDeliverTimeout = cfg.AnswerDeliverTimeout
+	}
+	if cfg.ChannelBuffer > 0 {
+		ctx.channelBuffer = cfg.ChannelBuffer
+	} else if cfg.ChannelBuffer < 0 {
+		ctx.channelBuffer = 0
+	}
+	if cfg.NATRedetectAfter > 0 {
+		ctx.natRedetection.threshold = cfg.NATRedetectAfter
+	} else if cfg.NATRedetectAfter < 0 {
+		ctx.natRedetection.threshold = 0
+	}
+	ctx.timeoutJitter = cfg.TimeoutJitter
+	ctx.matchStrategy = cfg.MatchStrategy
+	ctx.qualityMatching = cfg.QualityMatching
+	ctx.regionMatching = cfg.RegionMatching
+	ctx.allowRestrictedFallback = cfg.AllowRestrictedFallback
+	ctx.iceServers = cfg.ICEServers
+	if len(cfg.ProxyRegions) > 0 {
+		ctx.allowedRegions = make(map[string]bool)
+		for _, region := range cfg.ProxyRegions {
+			ctx.allowedRegions[region] = true
+		}
+	}
+	ctx.proxyTypeWeights = proxyTypeWeights
+	if cfg.ClientFanout > 0 {
+		ctx.clientFanout = cfg.ClientFanout
+	}
+	ctx.proxyLifetimes.maxLifetime = cfg.MaxProxyLifetime
+	ctx.proxyLifetimes.cooldown = cfg.ProxyLifetimeCooldown
+	ctx.proxyQuarantine.threshold = cfg.QuarantineAfter
+	ctx.proxyQuarantine.window = cfg.QuarantineWindow
+	ctx.proxyQuarantine.cooldown = cfg.QuarantineCooldown
+	ctx.proxyHeartbeats.staleAfter = cfg.ProxyStaleAfter
+	if len(cfg.AllowedProxyTypes) > 0 {
+		ctx.allowedProxyTypes = make(map[string]bool)
+		for _, proxyType := range cfg.AllowedProxyTypes {
+			ctx.allowedProxyTypes[proxyType] = true
+		}
+	}
+	if cfg.AllowedProxyTypesFile != "" {
+		ctx.allowedProxyTypes, err = loadProxyTypes(cfg.AllowedProxyTypesFile)
+		if err != nil {
+			return err
+		}
+	}
 
-	if !disableGeoip {
-		err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database)
+	if cfg.DecoyPage != "" {
+		ctx.decoyPage, err = ioutil.ReadFile(cfg.DecoyPage)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.ProxyTiersFile != "" {
+		ctx.proxyTiers, err = loadProxyTiers(cfg.ProxyTiersFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.AdminTokenFile != "" {
+		ctx.adminToken, err = loadAdminToken(cfg.AdminTokenFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.MetricsAuth != "" {
+		ctx.metricsAuth, err = parseBasicAuthCredentials(cfg.MetricsAuth)
+		if err != nil {
+			return fmt.Errorf("invalid metrics auth: %v", err)
+		}
+	}
+
+	if !cfg.DisableGeoip {
+		err = ctx.metrics.LoadGeoipDatabases(cfg.GeoipDatabase, cfg.Geoip6Database)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.GeoipRefreshURL != "" {
+		if cfg.DisableGeoip {
+			return fmt.Errorf("geoip refresh requires geoip to be enabled")
+		}
+		if cfg.GeoipRefreshInterval <= 0 {
+			return fmt.Errorf("geoip refresh interval %v is not positive", cfg.GeoipRefreshInterval)
+		}
+		refresher, err := newGeoipRefresher(cfg.GeoipRefreshURL, cfg.GeoipRefreshProxy,
+			cfg.GeoipDatabase, cfg.Geoip6Database, ctx.metrics)
 		if err != nil {
-			log.Fatal(err.Error())
+			return err
+		}
+		go refresher.run(cfg.GeoipRefreshInterval)
+	}
+
+	var blocklist *Blocklist
+	if cfg.BlocklistFile != "" {
+		blocklist = NewBlocklist()
+		if err := blocklist.Load(cfg.BlocklistFile); err != nil {
+			return err
 		}
 	}
 
+	ctx.config = newEffectiveConfig(cfg, ctx)
+
 	go ctx.Broker()
 
-	http.HandleFunc("/robots.txt", robotsTxtHandler)
+	// Exercise the matching pipeline without opening any listeners.
+	if cfg.SelfTest {
+		return ctx.SelfTest()
+	}
+
+	mux := newServeMux(ctx, cfg)
+
+	// Serve the admin endpoints on their own listener, off the public
+	// signaling surface, to operators holding a client certificate.
+	if cfg.AdminAddr != "" {
+		if cfg.AdminCertFilename == "" || cfg.AdminKeyFilename == "" || cfg.AdminClientCAFile == "" {
+			return fmt.Errorf("the admin listener requires a certificate, key, and client CA")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.AdminCertFilename, cfg.AdminKeyFilename)
+		if err != nil {
+			return err
+		}
+		roots, err := loadCertPool(cfg.AdminClientCAFile)
+		if err != nil {
+			return err
+		}
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/drain", AdminHandler{ctx, drainHandler})
+		adminMux.Handle("/admin/undrain", AdminHandler{ctx, undrainHandler})
+		adminMux.Handle("/admin/config", AdminHandler{ctx, configHandler})
+		adminMux.Handle("/admin/heap", AdminHandler{ctx, heapHandler})
+		adminTLSConfig := tlsConfig.Clone()
+		adminTLSConfig.Certificates = []tls.Certificate{cert}
+		adminTLSConfig.ClientAuth = tls.RequestClientCert
+		adminServer := &http.Server{
+			Handler:   NewSecurityHeadersHandler(NewClientCertHandler(adminMux, roots)),
+			TLSConfig: adminTLSConfig,
+		}
+		adminListener, err := net.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			return err
+		}
+		defer adminServer.Close()
+		go func() {
+			if err := adminServer.ServeTLS(adminListener, "", ""); err != http.ErrServerClosed {
+				log.Printf("admin listener stopped with error: %v", err)
+			}
+		}()
+	}
 
-	http.Handle("/proxy", SnowflakeHandler{ctx, proxyPolls})
-	http.Handle("/client", SnowflakeHandler{ctx, clientOffers})
-	http.Handle("/answer", SnowflakeHandler{ctx, proxyAnswers})
-	http.Handle("/debug", SnowflakeHandler{ctx, debugHandler})
-	http.Handle("/metrics", MetricsHandler{metricsFilename, metricsHandler})
-	http.Handle("/prometheus", promhttp.HandlerFor(ctx.metrics.promMetrics.registry, promhttp.HandlerOpts{}))
+	var handler http.Handler = mux
+	if len(vhostPools) > 0 {
+		handler = newVhostHandler(ctx, cfg, vhostPools)
+	}
+	handler = NewSecurityHeadersHandler(handler)
+	if cfg.AuditInterval > 0 {
+		go ctx.auditEvery(cfg.AuditInterval)
+		for _, pool := range ctx.vhostPools {
+			go pool.auditEvery(cfg.AuditInterval)
+		}
+	}
+	if cfg.ProxyStaleAfter > 0 {
+		go ctx.updateStaleProxiesEvery(cfg.ProxyStaleAfter / 2)
+	}
+	if blocklist != nil {
+		handler = NewBlocklistHandler(handler, blocklist)
+	}
+	if cfg.AccessLogFilename != "" {
+		accessLogFile, err := os.OpenFile(cfg.AccessLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		// Always scrub the access log, since it records every remote address.
+		accessLogger := log.New(&safelog.LogScrubber{Output: accessLogFile}, "", log.LstdFlags|log.LUTC)
+		handler = NewAccessLogHandler(handler, accessLogger)
+	}
 
 	server := http.Server{
-		Addr: addr,
+		Addr:    cfg.Addr,
+		Handler: handler,
 	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
 
-	// go routine to handle a SIGHUP signal to allow the broker operator to send
-	// a SIGHUP signal when the geoip database files are updated, without requiring
-	// a restart of the broker
+	// Let the broker operator send a SIGHUP when the geoip databases, the
+	// blocklist, or the other files of configuration are updated, without
+	// requiring a restart of the broker.
+	go ctx.reloadOnSignal(sigChan, cfg, blocklist, func() {
+		if err := metricsFile.Sync(); err != nil {
+			log.Printf("syncing metrics file returned error: %v", err)
+		}
+	})
+
+	// Shut down gracefully on SIGINT or SIGTERM, letting requests in progress
+	// finish, so that Run returns and syncs the metrics file.
+	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(shutdownChan)
+	stopped := make(chan struct{})
+	defer close(stopped)
 	go func() {
-		for {
-			signal := <-sigChan
-			log.Printf("Received signal: %s. Reloading geoip databases.", signal)
-			if err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
-				log.Fatalf("reload of Geo IP databases on signal %s returned error: %v", signal, err)
-			}
+		var signal os.Signal
+		select {
+		case signal = <-shutdownChan:
+		case <-stopped:
+			return
+		}
+		log.Printf("Received signal: %s. Shutting down.", signal)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutting down returned error: %v", err)
 		}
 	}()
 
+	// Let the operator start draining the broker with a signal as well.
+	if len(drainSignals) > 0 {
+		drainChan := make(chan os.Signal, 1)
+		signal.Notify(drainChan, drainSignals...)
+		go func() {
+			for signal := range drainChan {
+				log.Printf("Received signal: %s. Draining.", signal)
+				ctx.SetDraining(true)
+			}
+		}()
+	}
+
 	// Handle the various ways of setting up TLS. The legal configurations
 	// are:
 	//   --acme-hostnames (with optional --acme-email and/or --acme-cert-cache)
@@ -523,42 +2410,181 @@ func RunBroker(addr string) {
 	//   --disable-tls
 	// The outputs of this block of code are the disableTLS,
 	// needHTTP01Listener, certManager, and getCertificate variables.
-	if acmeHostnamesCommas != "" {
-		acmeHostnames := strings.Split(acmeHostnamesCommas, ",")
-		log.Printf("ACME hostnames: %q", acmeHostnames)
+	if len(cfg.AcmeHostnames) > 0 {
+		log.Printf("ACME hostnames: %q", cfg.AcmeHostnames)
 
 		var cache autocert.Cache
-		if err = os.MkdirAll(acmeCertCacheDir, 0700); err != nil {
-			log.Printf("Warning: Couldn't create cache directory %q (reason: %s) so we're *not* using our certificate cache.", acmeCertCacheDir, err)
+		if err = os.MkdirAll(cfg.AcmeCertCacheDir, 0700); err != nil {
+			log.Printf("Warning: Couldn't create cache directory %q (reason: %s) so we're *not* using our certificate cache.", cfg.AcmeCertCacheDir, err)
 		} else {
-			cache = autocert.DirCache(acmeCertCacheDir)
+			cache = autocert.DirCache(cfg.AcmeCertCacheDir)
 		}
 
 		certManager := autocert.Manager{
 			Cache:      cache,
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(acmeHostnames...),
-			Email:      acmeEmail,
+			HostPolicy: autocert.HostWhitelist(cfg.AcmeHostnames...),
+			Email:      cfg.AcmeEmail,
 		}
+		errChan := make(chan error, 2)
 		go func() {
 			log.Printf("Starting HTTP-01 listener")
-			log.Fatal(http.ListenAndServe(":80", certManager.HTTPHandler(nil)))
+			errChan <- http.ListenAndServe(":80", certManager.HTTPHandler(nil))
 		}()
 
-		server.TLSConfig = &tls.Config{GetCertificate: certManager.GetCertificate}
-		err = server.ListenAndServeTLS("", "")
-	} else if certFilename != "" && keyFilename != "" {
-		if acmeEmail != "" || acmeHostnamesCommas != "" {
-			log.Fatalf("The --cert and --key options are not allowed with --acme-email or --acme-hostnames.")
+		tlsConfig.GetCertificate = certManager.GetCertificate
+		server.TLSConfig = tlsConfig
+		go func() {
+			errChan <- server.ListenAndServeTLS("", "")
+		}()
+		if cfg.AcmeWarmCache {
+			go warmCertificates(certManager.GetCertificate, cfg.AcmeHostnames)
 		}
-		err = server.ListenAndServeTLS(certFilename, keyFilename)
-	} else if disableTLS {
-		err = server.ListenAndServe()
-	} else {
-		log.Fatal("the --acme-hostnames, --cert and --key, or --disable-tls option is required")
+		return serverStopped(<-errChan)
+	} else if cfg.CertFilename != "" && cfg.KeyFilename != "" {
+		if cfg.AcmeEmail != "" {
+			return fmt.Errorf("the --cert and --key options are not allowed with --acme-email or --acme-hostnames")
+		}
+		// Pick up renewed certificates without a restart.
+		reloader, err := newCertReloader(cfg.CertFilename, cfg.KeyFilename)
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		server.TLSConfig = tlsConfig
+		return serverStopped(server.ListenAndServeTLS("", ""))
+	} else if cfg.DisableTLS {
+		if cfg.EnableH2C {
+			// Accept HTTP/2 without TLS as well as HTTP/1.1, for a
+			// TLS-terminating proxy in front of the broker.
+			server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+		}
+		return serverStopped(server.ListenAndServe())
 	}
+	return fmt.Errorf("the --acme-hostnames, --cert and --key, or --disable-tls option is required")
+}
 
-	if err != nil {
+// Returns the error with which the server stopped, or nil if it was shut down.
+func serverStopped(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Parses the broker's command-line flags and runs it listening on addr,
+// exiting the program if it fails.
+func RunBroker(addr string) {
+	var cfg Config
+	var acmeHostnamesCommas string
+	var corsAllowedOriginsCommas string
+	var allowedProxyTypesCommas string
+	var proxyRegionsCommas string
+	var iceServersCommas string
+
+	cfg.Addr = addr
+	flag.StringVar(&cfg.AcmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
+	flag.StringVar(&acmeHostnamesCommas, "acme-hostnames", "", "comma-separated hostnames for TLS certificate")
+	flag.StringVar(&cfg.AcmeCertCacheDir, "acme-cert-cache", "", "directory in which certificates should be cached")
+	flag.BoolVar(&cfg.AcmeWarmCache, "acme-warm-cache", false, "fetch the certificates of the ACME hostnames at startup rather than on their first handshake")
+	flag.StringVar(&cfg.CertFilename, "cert", "", "TLS certificate file")
+	flag.StringVar(&cfg.KeyFilename, "key", "", "TLS private key file")
+	flag.StringVar(&cfg.GeoipDatabase, "geoipdb", "", "path to correctly formatted geoip database mapping IPv4 address ranges to country codes")
+	flag.StringVar(&cfg.Geoip6Database, "geoip6db", "", "path to correctly formatted geoip database mapping IPv6 address ranges to country codes")
+	flag.BoolVar(&cfg.DisableTLS, "disable-tls", true, "don't use HTTPS")
+	flag.BoolVar(&cfg.EnableH2C, "enable-h2c", false, "also accept HTTP/2 without TLS (h2c); requires --disable-tls")
+	flag.StringVar(&cfg.GeoipRefreshURL, "geoip-refresh-url", "", "base URL from which to periodically download updated \"geoip\" and \"geoip6\" databases")
+	flag.DurationVar(&cfg.GeoipRefreshInterval, "geoip-refresh-interval", 24*time.Hour, "how often to download updated geoip databases")
+	flag.StringVar(&cfg.GeoipRefreshProxy, "geoip-refresh-proxy", "", "http, https, or socks5 proxy URL for geoip downloads (default from HTTP_PROXY/HTTPS_PROXY)")
+	flag.BoolVar(&cfg.DisableGeoip, "disable-geoip", true, "don't use geoip for stats collection")
+	flag.StringVar(&cfg.BlocklistFile, "blocklist-file", "", "path to a file of CIDR ranges, one per line, whose requests are rejected (reloaded on SIGHUP)")
+	flag.StringVar(&cfg.MetricsFilename, "metrics-log", "", "path to metrics logging output")
+	flag.StringVar(&cfg.MetricsFormat, "metrics-format", "text", "format of the metrics log: text, csv, or json")
+	flag.BoolVar(&cfg.UnsafeLogging, "unsafe-logging", true, "prevent logs from being scrubbed")
+	flag.StringVar(&cfg.LogLevel, "log-level", LogLevelInfo, "\""+LogLevelInfo+"\", or \""+LogLevelDebug+"\" to also log each match decision, scrubbed")
+	flag.BoolVar(&cfg.EnableDebugEndpoint, "enable-debug-endpoint", false, "serve /debug, which shows how the pool of proxies is made up")
+	flag.StringVar(&cfg.DecoyPage, "decoy-page", "", "HTML file to serve at /, so that the broker looks like a generic web server")
+	flag.BoolVar(&cfg.SelfTest, "self-test", false, "run a synthetic offer/answer round trip through the broker and exit")
+	flag.DurationVar(&cfg.ClientTimeout, "client-timeout", ClientTimeout*time.Second, "how long a client waits for a proxy's answer")
+	flag.DurationVar(&cfg.ClientTimeoutRestricted, "client-timeout-restricted", 0, "how long a client waits for the answer of a restricted proxy (0 for --client-timeout)")
+	flag.DurationVar(&cfg.ClientTimeoutUnrestricted, "client-timeout-unrestricted", 0, "how long a client waits for the answer of an unrestricted proxy (0 for --client-timeout)")
+	flag.DurationVar(&cfg.MaxClientTimeout, "max-client-timeout", defaultMaxClientTimeout, "longest timeout a client may ask for with the Snowflake-Client-Timeout header")
+	flag.DurationVar(&cfg.MatchDeadline, "match-deadline", 0, "longest a client's match may take in all, from its offer arriving to its proxy's answer (0 for no limit)")
+	flag.DurationVar(&cfg.ProxyTimeout, "proxy-timeout", ProxyTimeout*time.Second, "how long a proxy waits for a client's offer")
+	flag.DurationVar(&cfg.MinAdaptiveProxyTimeout, "min-adaptive-proxy-timeout", 0, "shortest proxy timeout, which adapts to the rate at which clients arrive if positive")
+	flag.DurationVar(&cfg.MaxAdaptiveProxyTimeout, "max-adaptive-proxy-timeout", 0, "longest adaptive proxy timeout (0 for the proxy timeout)")
+	flag.DurationVar(&cfg.MaxProxyTimeout, "max-proxy-timeout", defaultMaxProxyTimeout, "longest wait for an offer a proxy may ask for in its poll")
+	flag.Float64Var(&cfg.TimeoutJitter, "timeout-jitter", 0.1, "fraction of the proxy timeout by which to randomize it, to spread out re-polls")
+	flag.IntVar(&cfg.NATRedetectAfter, "nat-redetect-after", defaultNATRedetectAfter, "number of failed matches in a row after which a proxy is asked to detect its NAT type again (-1 for never)")
+	flag.IntVar(&cfg.AnswerRetries, "answer-retries", 3, "how many times to retry handing a proxy's answer to its client, "+answerRetryInterval.String()+" apart (-1 for none)")
+	flag.DurationVar(&cfg.AnswerDeliverTimeout, "answer-deliver-timeout", defaultAnswerDeliverTimeout, "longest to keep trying to hand a proxy's answer to its client, however many retries are left")
+	flag.IntVar(&cfg.ChannelBuffer, "channel-buffer", defaultChannelBuffer, "capacity of each proxy's offer and answer channels, so that neither side waits for the other to be ready (-1 for unbuffered)")
+	flag.IntVar(&cfg.MaxInflightClients, "max-inflight-clients", 0, "maximum number of client offers handled at once, beyond which offers get a 503 (0 for no limit)")
+	flag.IntVar(&cfg.MaxClientOffersPerMinute, "max-client-offers-per-minute", 0, "maximum number of offers each client, identified by a daily-salted hash of its IP address, may make a minute, beyond which offers get a 429 (0 for no limit)")
+	flag.IntVar(&cfg.MinProxiesBeforeServing, "min-proxies-before-serving", 0, "number of proxies that must first be available before clients are served, asking earlier clients to retry later")
+	flag.DurationVar(&cfg.ShedLatency, "shed-latency", 0, "shed a growing fraction of client offers with a 503 while the client roundtrip estimate is above this (0 to never shed)")
+	flag.DurationVar(&cfg.AuditInterval, "audit-interval", 0, "how often to audit the proxy heaps for inconsistencies and repair them (0 to never audit)")
+	flag.IntVar(&cfg.MaxTrackedProxies, "max-tracked-proxies", 0, "maximum number of proxies tracked at once, beyond which the oldest are forgotten (0 for no limit)")
+	flag.IntVar(&cfg.BrokerWorkers, "broker-workers", 0, "maximum number of proxy polls waiting for a client at once, beyond which polls get a 503 (0 for no limit)")
+	flag.BoolVar(&cfg.RequireSDPFingerprint, "require-sdp-fingerprint", false, "reject client offers and proxy answers without a DTLS fingerprint and a media section")
+	flag.DurationVar(&cfg.ClientQueueWait, "client-queue-wait", 0, "how long a client may wait for a proxy if none are available (0 to deny immediately)")
+	flag.DurationVar(&cfg.MaxOfferAge, "max-offer-age", 0, "deny client offers older than this when matched with a proxy (0 for no limit)")
+	flag.StringVar(&cfg.AccessLogFilename, "access-log", "", "path to access log output, with IP addresses scrubbed")
+	flag.StringVar(&cfg.EventLogFilename, "event-log", "", "path to a newline-delimited JSON log of match events, without IP addresses")
+	flag.Float64Var(&cfg.EventSampleRate, "event-sample-rate", 1, "fraction of match events written to the event log")
+	flag.StringVar(&cfg.CORSOrigin, "cors-origin", "*", "origin allowed to make cross-origin requests to the signaling endpoints")
+	flag.DurationVar(&cfg.CORSMaxAge, "cors-max-age", defaultCORSMaxAge, "how long browsers may cache CORS preflight responses")
+	flag.StringVar(&corsAllowedOriginsCommas, "cors-allowed-origins", "", "comma-separated origins allowed to make cross-origin requests, overriding --cors-origin")
+	flag.StringVar(&cfg.FallbackBrokerURL, "fallback-broker-url", "", "URL of a broker to point clients at when no proxies are available")
+	flag.StringVar(&cfg.ShadowBrokerURL, "shadow-broker-url", "", "URL of a broker to mirror the metadata of client offers and proxy polls to, without their SDP, discarding its responses")
+	flag.StringVar(&cfg.MatchStrategy, "match-strategy", MatchLeastLoaded, "how to choose a proxy for a client: \""+MatchLeastLoaded+"\" or \""+MatchRoundRobin+"\"")
+	flag.BoolVar(&cfg.QualityMatching, "quality-matching", false, "prefer proxies whose acknowledged connections have succeeded more often over those equally loaded")
+	flag.StringVar(&proxyRegionsCommas, "proxy-regions", "", "comma-separated regions or datacenters proxies may declare themselves in, such as eu-west,us-east")
+	flag.BoolVar(&cfg.RegionMatching, "region-matching", false, "prefer proxies of the region a client asks for with the Snowflake-Region header")
+	flag.BoolVar(&cfg.AllowRestrictedFallback, "allow-restricted-fallback", false, "match restricted clients with restricted proxies as a last resort when no unrestricted proxy is available")
+	flag.StringVar(&iceServersCommas, "ice-servers", "", "comma-separated STUN or TURN server URLs to suggest to proxies with client offers")
+	flag.IntVar(&cfg.ClientFanout, "client-fanout", 1, "number of proxies to pass each client offer to at once, answering with the first to answer")
+	flag.StringVar(&cfg.VhostPools, "vhost-pools", "", "comma-separated host=pool pairs giving virtual hosts separate pools of proxies, such as a.example=alpha,b.example=beta")
+	flag.StringVar(&cfg.ProxyTypeWeights, "proxy-type-weights", "", "comma-separated proxyType=weight pairs of relative proxy capacities, such as standalone=4,webext=1")
+	flag.StringVar(&allowedProxyTypesCommas, "allowed-proxy-types", "", "comma-separated proxy types allowed to poll, such as standalone,webext (default all)")
+	flag.StringVar(&cfg.AllowedProxyTypesFile, "allowed-proxy-types-file", "", "file of proxy types allowed to poll, one per line, overriding --allowed-proxy-types and reloaded on SIGHUP")
+	flag.DurationVar(&cfg.MaxProxyLifetime, "max-proxy-lifetime", 0, "how long a proxy id may keep registering after it was first seen (0 for no limit)")
+	flag.DurationVar(&cfg.ProxyLifetimeCooldown, "proxy-lifetime-cooldown", time.Hour, "how long a proxy id past --max-proxy-lifetime is refused")
+	flag.IntVar(&cfg.QuarantineAfter, "quarantine-after", 0, "failed answers within --quarantine-window after which a proxy id is refused for --quarantine-cooldown (0 to never quarantine)")
+	flag.DurationVar(&cfg.QuarantineWindow, "quarantine-window", 10*time.Minute, "window within which failed answers count towards quarantine")
+	flag.DurationVar(&cfg.QuarantineCooldown, "quarantine-cooldown", 30*time.Minute, "how long a quarantined proxy id is refused")
+	flag.DurationVar(&cfg.ProxyStaleAfter, "proxy-stale-after", 0, "time since its last poll after which a proxy is counted as stale (0 not to count stale proxies)")
+	flag.StringVar(&cfg.TLSMinVersion, "tls-min-version", "", "minimum TLS version to accept: 1.0, 1.1, 1.2, or 1.3")
+	flag.StringVar(&cfg.TLSCipherSuites, "tls-cipher-suites", "", "comma-separated list of TLS 1.2 cipher suites to allow")
+	flag.StringVar(&cfg.ProxyTiersFile, "proxy-tiers-file", "", "file of \"tier token\" lines allowing proxies that present the token to poll with the tier")
+	flag.StringVar(&cfg.AdminTokenFile, "admin-token-file", "", "file containing the bearer token for the /admin/ endpoints")
+	flag.StringVar(&cfg.MetricsAuth, "metrics-auth", "", "user:passhash, with the bcrypt hash of the password, required by HTTP basic authentication of /metrics and /prometheus")
+	flag.StringVar(&cfg.AdminAddr, "admin-addr", "", "address of a separate TLS listener for the /admin/ endpoints, requiring a client certificate")
+	flag.StringVar(&cfg.AdminCertFilename, "admin-cert", "", "TLS certificate file for the admin listener")
+	flag.StringVar(&cfg.AdminKeyFilename, "admin-key", "", "TLS private key file for the admin listener")
+	flag.StringVar(&cfg.AdminClientCAFile, "admin-client-ca", "", "file of PEM-encoded CA certificates whose client certificates the admin listener accepts")
+	flag.Parse()
+
+	if acmeHostnamesCommas != "" {
+		cfg.AcmeHostnames = strings.Split(acmeHostnamesCommas, ",")
+	}
+	if corsAllowedOriginsCommas != "" {
+		cfg.CORSAllowedOrigins = strings.Split(corsAllowedOriginsCommas, ",")
+	}
+	if allowedProxyTypesCommas != "" {
+		cfg.AllowedProxyTypes = strings.Split(allowedProxyTypesCommas, ",")
+	}
+	if proxyRegionsCommas != "" {
+		cfg.ProxyRegions = strings.Split(proxyRegionsCommas, ",")
+	}
+	if iceServersCommas != "" {
+		cfg.ICEServers = strings.Split(iceServersCommas, ",")
+	}
+
+	if err := Run(cfg); err != nil {
 		log.Fatal(err)
 	}
+	if cfg.SelfTest {
+		log.Println("self-test passed")
+	}
 }
@@ -0,0 +1,191 @@
+/*
+Package brokerclient is a client of the broker's signaling protocol, for tests
+and tooling that play the part of a proxy or a client.
+
+A proxy polls for a client's offer with PollOffer, returns its answer with
+SendAnswer, and may then report whether it connected with Ack. A client sends
+its offer with RequestConnection, which returns the answer of the proxy it was
+matched with.
+*/
+package brokerclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/RACECAR-GU/snowflake/common/messages"
+)
+
+// Largest response read from the broker.
+const readLimit = 100000
+
+var (
+	// Returned by SendAnswer if the client gave up before the answer
+	// arrived.
+	ErrClientGone = errors.New("client gone")
+	// Returned by RequestConnection if the broker had no proxy for the
+	// client.
+	ErrNoProxies = errors.New("no proxies available")
+	// Returned by RequestConnection if the proxy matched did not answer in
+	// time.
+	ErrTimeout = errors.New("timed out waiting for an answer")
+	// Returned by Ack if the broker did not recently deliver the proxy's
+	// answer.
+	ErrNotDelivered = errors.New("no answer delivered")
+)
+
+// A client offer received by a proxy.
+type Offer struct {
+	SDP string
+	// NAT type of the client that made the offer.
+	NAT string
+}
+
+// A client of one broker.
+type Client struct {
+	// Base URL of the broker, under which the endpoints are resolved.
+	URL *url.URL
+	// Client making the requests, or http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Returns a client of the broker at brokerURL.
+func New(brokerURL string) (*Client, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{URL: u}, nil
+}
+
+// Posts body to the endpoint at path, with the headers given, and returns the
+// status code and body of the response.
+func (c *Client) post(ctx context.Context, path string, body []byte, header http.Header) (int, []byte, error) {
+	endpoint := c.URL.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, readLimit))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, b, nil
+}
+
+// Polls the broker once as the proxy with session id, of proxyType and behind
+// a NAT of natType, and returns the offer of the client it was matched with,
+// or nil if none was matched before the broker's proxy timeout.
+func (c *Client) PollOffer(ctx context.Context, id, proxyType, natType string) (*Offer, error) {
+	body, err := messages.EncodePollRequest(id, proxyType, natType)
+	if err != nil {
+		return nil, err
+	}
+	status, resp, err := c.post(ctx, "proxy", body, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("broker returned status code %d", status)
+	}
+	sdp, clientNAT, err := messages.DecodePollResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if sdp == "" {
+		return nil, nil
+	}
+	return &Offer{SDP: sdp, NAT: clientNAT}, nil
+}
+
+// Sends the answer of the proxy with session id to the client whose offer it
+// was given, returning ErrClientGone if the client is no longer waiting.
+func (c *Client) SendAnswer(ctx context.Context, id, answer string) error {
+	body, err := messages.EncodeAnswerRequest(answer, id)
+	if err != nil {
+		return err
+	}
+	status, resp, err := c.post(ctx, "answer", body, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("broker returned status code %d", status)
+	}
+	success, err := messages.DecodeAnswerResponse(resp)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return ErrClientGone
+	}
+	return nil
+}
+
+// Reports whether the proxy with session id connected with the client its
+// answer was delivered to.
+func (c *Client) Ack(ctx context.Context, id string, connected bool) error {
+	status := messages.AckFailure
+	if connected {
+		status = messages.AckSuccess
+	}
+	body, err := messages.EncodeAckRequest(id, status)
+	if err != nil {
+		return err
+	}
+	code, _, err := c.post(ctx, "proxy/ack", body, nil)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotDelivered
+	default:
+		return fmt.Errorf("broker returned status code %d", code)
+	}
+}
+
+// Sends the offer of a client behind a NAT of natType, which may be empty if
+// unknown, and returns the answer of the proxy it was matched with. Returns
+// ErrNoProxies if the broker had no proxy to match it with, and ErrTimeout if
+// the proxy did not answer in time.
+func (c *Client) RequestConnection(ctx context.Context, offer, natType string) (string, error) {
+	header := make(http.Header)
+	if natType != "" {
+		header.Set("Snowflake-NAT-Type", natType)
+	}
+	status, resp, err := c.post(ctx, "client", []byte(offer), header)
+	if err != nil {
+		return "", err
+	}
+	switch status {
+	case http.StatusOK:
+		return string(resp), nil
+	case http.StatusServiceUnavailable:
+		return "", ErrNoProxies
+	case http.StatusGatewayTimeout:
+		return "", ErrTimeout
+	default:
+		return "", fmt.Errorf("broker returned status code %d", status)
+	}
+}
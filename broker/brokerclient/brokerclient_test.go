@@ -0,0 +1,112 @@
+package brokerclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RACECAR-GU/snowflake/common/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient(t *testing.T) {
+	Convey("Broker client", t, func() {
+		var status int
+		var body []byte
+		var request *http.Request
+		var requestBody []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			requestBody, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+			w.Write(body)
+		}))
+		defer server.Close()
+		c, err := New(server.URL + "/")
+		So(err, ShouldBeNil)
+		ctx := context.Background()
+
+		Convey("polls for an offer", func() {
+			status = http.StatusOK
+			body, err = messages.EncodePollResponse("fake offer", true, "restricted")
+			So(err, ShouldBeNil)
+			offer, err := c.PollOffer(ctx, "ymbcCMto7KHNGYlp", "standalone", "unrestricted")
+			So(err, ShouldBeNil)
+			So(offer, ShouldResemble, &Offer{SDP: "fake offer", NAT: "restricted"})
+			So(request.URL.Path, ShouldEqual, "/proxy")
+			sid, proxyType, natType, err := messages.DecodePollRequest(requestBody)
+			So(err, ShouldBeNil)
+			So([]string{sid, proxyType, natType}, ShouldResemble, []string{"ymbcCMto7KHNGYlp", "standalone", "unrestricted"})
+
+			body, err = messages.EncodePollResponse("", false, "")
+			So(err, ShouldBeNil)
+			offer, err = c.PollOffer(ctx, "ymbcCMto7KHNGYlp", "standalone", "unrestricted")
+			So(err, ShouldBeNil)
+			So(offer, ShouldBeNil)
+
+			status = http.StatusForbidden
+			_, err = c.PollOffer(ctx, "ymbcCMto7KHNGYlp", "standalone", "unrestricted")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("sends an answer", func() {
+			status = http.StatusOK
+			body, err = messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+			So(c.SendAnswer(ctx, "ymbcCMto7KHNGYlp", "fake answer"), ShouldBeNil)
+			So(request.URL.Path, ShouldEqual, "/answer")
+			answer, sid, err := messages.DecodeAnswerRequest(requestBody)
+			So(err, ShouldBeNil)
+			So(answer, ShouldEqual, "fake answer")
+			So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+
+			body, err = messages.EncodeAnswerResponse(false)
+			So(err, ShouldBeNil)
+			So(c.SendAnswer(ctx, "ymbcCMto7KHNGYlp", "fake answer"), ShouldEqual, ErrClientGone)
+		})
+
+		Convey("acknowledges a connection", func() {
+			status = http.StatusOK
+			body = nil
+			So(c.Ack(ctx, "ymbcCMto7KHNGYlp", false), ShouldBeNil)
+			So(request.URL.Path, ShouldEqual, "/proxy/ack")
+			sid, ackStatus, err := messages.DecodeAckRequest(requestBody)
+			So(err, ShouldBeNil)
+			So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+			So(ackStatus, ShouldEqual, messages.AckFailure)
+
+			status = http.StatusNotFound
+			So(c.Ack(ctx, "ymbcCMto7KHNGYlp", true), ShouldEqual, ErrNotDelivered)
+		})
+
+		Convey("requests a connection", func() {
+			status = http.StatusOK
+			body = []byte("fake answer")
+			answer, err := c.RequestConnection(ctx, "fake offer", "restricted")
+			So(err, ShouldBeNil)
+			So(answer, ShouldEqual, "fake answer")
+			So(request.URL.Path, ShouldEqual, "/client")
+			So(request.Header.Get("Snowflake-NAT-Type"), ShouldEqual, "restricted")
+			So(string(requestBody), ShouldEqual, "fake offer")
+
+			body = nil
+			for code, expected := range map[int]error{
+				http.StatusServiceUnavailable: ErrNoProxies,
+				http.StatusGatewayTimeout:     ErrTimeout,
+			} {
+				status = code
+				_, err := c.RequestConnection(ctx, "fake offer", "")
+				So(err, ShouldEqual, expected)
+			}
+		})
+
+		Convey("gives up when the context is done", func() {
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := c.RequestConnection(canceled, "fake offer", "")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,120 @@
+/*
+Short opaque identifiers of clients, for per-client policy such as rate
+limiting without keeping their IP addresses. An identifier is a keyed hash of
+the client's IP address, under a random salt that is replaced daily and never
+stored, so that identifiers cannot be mapped back to addresses nor correlated
+across days. Identifiers are not logged.
+*/
+
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a salt is used before it is replaced.
+	clientIDSaltLifetime = 24 * time.Hour
+	// Bytes of the hash kept in an identifier.
+	clientIDLength = 8
+	// Window over which client offers are counted against the limit.
+	clientRateWindow = 1 * time.Minute
+	// Most clients whose offers are counted in a window; those beyond are
+	// not limited.
+	maxRateLimitedClients = 100000
+)
+
+type clientIDs struct {
+	lock    sync.Mutex
+	salt    []byte
+	rotated time.Time
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+
+	// Most offers a client may make in a clientRateWindow, or no limit if
+	// zero.
+	limit int
+	// Offers made in the window starting at windowStart, by identifier.
+	offers      map[string]int
+	windowStart time.Time
+}
+
+func (c *clientIDs) currentTime() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Replaces the salt if it has outlived clientIDSaltLifetime. Called with the
+// lock held.
+func (c *clientIDs) rotate(now time.Time) {
+	if c.salt != nil && now.Sub(c.rotated) < clientIDSaltLifetime {
+		return
+	}
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	c.salt = salt
+	c.rotated = now
+	// Counts under the old salt no longer match anyone.
+	c.offers = nil
+}
+
+func (c *clientIDs) idAt(ip string, now time.Time) string {
+	c.rotate(now)
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:clientIDLength])
+}
+
+// Returns the identifier of the client at ip under the current salt.
+func (c *clientIDs) id(ip string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.idAt(ip, c.currentTime())
+}
+
+// Returns the identifier of the client making r, or "" if its remote address
+// is not an IP address and port.
+func (c *clientIDs) requestID(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return c.id(ip)
+}
+
+// Counts an offer by the client with identifier id, returning false if it is
+// over the limit for the current window.
+func (c *clientIDs) allow(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.limit <= 0 {
+		return true
+	}
+	now := c.currentTime()
+	c.rotate(now)
+	if c.offers == nil || now.Sub(c.windowStart) >= clientRateWindow {
+		c.offers = make(map[string]int)
+		c.windowStart = now
+	}
+	count, ok := c.offers[id]
+	if !ok && len(c.offers) >= maxRateLimitedClients {
+		return true
+	}
+	if count >= c.limit {
+		return false
+	}
+	c.offers[id] = count + 1
+	return true
+}
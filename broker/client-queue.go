@@ -0,0 +1,98 @@
+/*
+Bounded queues of clients waiting briefly for a snowflake proxy to become
+available, so that short bursts of clients are not denied immediately. Each
+queue is served oldest first, so that a client cannot be starved by later ones
+when proxies arrive only sporadically.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of clients waiting for each kind of snowflake.
+	clientQueueSize = 1000
+)
+
+// A client waiting for a snowflake. Exactly one of the Broker handing over a
+// snowflake and the client giving up marks the wait as done.
+type waitingClient struct {
+	lock      sync.Mutex
+	done      bool
+	snowflake chan *Snowflake
+	// When the client joined the queue, and its place in it then, counting
+	// from 1.
+	enqueued time.Time
+	position int
+	// NAT type of the client, for logging the match.
+	natType string
+}
+
+func newWaitingClient(position int) *waitingClient {
+	return &waitingClient{
+		snowflake: make(chan *Snowflake, 1),
+		enqueued:  time.Now(),
+		position:  position,
+	}
+}
+
+// Blocks until a snowflake is handed over, or the timeout expires or done is
+// closed, in which case it returns nil.
+func (waiting *waitingClient) wait(timeout time.Duration, done <-chan struct{}) *Snowflake {
+	select {
+	case snowflake := <-waiting.snowflake:
+		return snowflake
+	case <-time.After(timeout):
+	case <-done:
+	}
+	waiting.lock.Lock()
+	defer waiting.lock.Unlock()
+	if waiting.done {
+		// A snowflake was handed over just as we timed out.
+		return <-waiting.snowflake
+	}
+	waiting.done = true
+	return nil
+}
+
+// Returns the queue of clients waiting for snowflakes of the given heap.
+func (ctx *BrokerContext) clientQueue(snowflakeHeap *SnowflakeHeap) chan *waitingClient {
+	if snowflakeHeap == ctx.restrictedSnowflakes || snowflakeHeap == ctx.priorityRestrictedSnowflakes {
+		return ctx.waitingForRestrictedSnowflakes
+	}
+	return ctx.waitingForSnowflakes
+}
+
+// Hands a newly available snowflake to the longest waiting client that has
+// not yet given up, removing it from the heap. Clients that gave up are
+// discarded from the queue. Does nothing if no client is waiting.
+func (ctx *BrokerContext) serveWaitingClient(snowflake *Snowflake) {
+	snowflakeHeap := ctx.heapFor(snowflake)
+	queue := ctx.clientQueue(snowflakeHeap)
+
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+	for snowflake.index != -1 {
+		var waiting *waitingClient
+		select {
+		case waiting = <-queue:
+		default:
+			return
+		}
+		waiting.lock.Lock()
+		if !waiting.done {
+			snowflakeHeap.Remove(snowflake)
+			ctx.metrics.promMetrics.ProxyLoad.Observe(snowflake.load())
+			ctx.metrics.lock.Lock()
+			ctx.metrics.UpdateClientQueueWait(time.Since(waiting.enqueued))
+			ctx.metrics.lock.Unlock()
+			waiting.done = true
+			ctx.logMatch(waiting.natType, snowflakeHeap, snowflake, []string{"queue"})
+			waiting.snowflake <- snowflake
+		}
+		waiting.lock.Unlock()
+	}
+}
@@ -0,0 +1,46 @@
+/*
+Tracking of the client session ids with an offer in flight, so that a client
+retrying its offer while the first is still being matched does not take up a
+second proxy.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How long past the longest possible match a session id is remembered,
+	// should it somehow not be released.
+	clientSessionGrace = 5 * time.Second
+)
+
+type clientSessions struct {
+	lock    sync.Mutex
+	expires map[string]time.Time
+}
+
+// Marks the session id as having an offer in flight, waiting up to
+// clientTimeout for its answer, returning false if it already has one.
+func (ctx *BrokerContext) claimClientSession(id string, clientTimeout time.Duration) bool {
+	ctx.clientSessions.lock.Lock()
+	defer ctx.clientSessions.lock.Unlock()
+
+	now := time.Now()
+	if expires, ok := ctx.clientSessions.expires[id]; ok && now.Before(expires) {
+		return false
+	}
+	if ctx.clientSessions.expires == nil {
+		ctx.clientSessions.expires = make(map[string]time.Time)
+	}
+	ctx.clientSessions.expires[id] = now.Add(ctx.clientQueueWait + clientTimeout + clientSessionGrace)
+	return true
+}
+
+func (ctx *BrokerContext) releaseClientSession(id string) {
+	ctx.clientSessions.lock.Lock()
+	delete(ctx.clientSessions.expires, id)
+	ctx.clientSessions.lock.Unlock()
+}
@@ -0,0 +1,160 @@
+/*
+Client offers over a WebSocket, for clients that keep a connection to the
+broker open rather than POST each offer to /client.
+
+The client first sends a handshake message, a JSON object of the headers it
+would send with a POST, such as {"Snowflake-NAT-Type": "unrestricted"}. Each
+following message is an offer, matched as clientOffers matches a POSTed one,
+and is replied to with a clientWSResponse.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Headers of a POSTed offer that a handshake may give.
+var clientWSHeaders = []string{
+	"X-Session-ID",
+	"Snowflake-NAT-Type",
+	"Snowflake-Proxy-Type-Preference",
+	"Snowflake-Priority",
+	"Snowflake-Region",
+	"Snowflake-Client-Timeout",
+	"Snowflake-Offer-Encoding",
+}
+
+// Statuses of clientWSResponse, by the status code of the corresponding
+// response to a POSTed offer.
+var clientWSStatuses = map[int]string{
+	http.StatusOK:                 "matched",
+	http.StatusBadRequest:         "malformed",
+	http.StatusConflict:           "conflict",
+	http.StatusServiceUnavailable: "denied",
+	http.StatusGatewayTimeout:     "timeout",
+}
+
+// Reply to an offer sent over a WebSocket.
+type clientWSResponse struct {
+	Status string `json:"status"`
+	Answer string `json:"answer,omitempty"`
+	// Tag of the envelope the answer is wrapped in, if any.
+	AnswerEncoding string `json:"answer_encoding,omitempty"`
+	// URL of the fallback broker to retry with, if denied.
+	Fallback string `json:"fallback,omitempty"`
+	// Place the client had in the queue, if it was matched after waiting.
+	QueuePosition int `json:"queue_position,omitempty"`
+}
+
+// Collects the response clientOffers writes for an offer received over a
+// WebSocket.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(b)
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+// Reports whether a WebSocket may be opened from origin, by the same rules as
+// cross-origin requests to the other signaling endpoints.
+func (ctx *BrokerContext) allowedOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	if len(ctx.corsAllowedOrigins) > 0 {
+		return ctx.corsAllowedOrigins[origin]
+	}
+	return ctx.corsOrigin == "*" || ctx.corsOrigin == origin
+}
+
+func clientWebSocket(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return ctx.allowedOrigin(r.Header.Get("Origin"))
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with an error.
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(readLimit)
+
+	var handshake map[string]string
+	if err := conn.ReadJSON(&handshake); err != nil {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "client", "reason": "undecodable"}).Inc()
+		return
+	}
+	header := make(http.Header)
+	for _, key := range clientWSHeaders {
+		for name, value := range handshake {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(key) {
+				header.Set(key, value)
+			}
+		}
+	}
+
+	for {
+		_, offer, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req, err := http.NewRequestWithContext(r.Context(), "POST", "/client", bytes.NewReader(offer))
+		if err != nil {
+			return
+		}
+		req.Header = header.Clone()
+		req.RemoteAddr = r.RemoteAddr
+		req.TLS = r.TLS
+
+		resp := &bufferedResponse{header: make(http.Header)}
+		clientOffers(ctx, resp, req)
+
+		reply := clientWSResponse{
+			Status:   clientWSStatuses[resp.status],
+			Fallback: resp.header.Get("Snowflake-Fallback"),
+		}
+		if reply.Status == "" {
+			reply.Status = "error"
+		}
+		if resp.status == http.StatusOK {
+			reply.Answer = resp.body.String()
+			reply.AnswerEncoding = resp.header.Get("Snowflake-Answer-Encoding")
+			reply.QueuePosition, _ = strconv.Atoi(resp.header.Get("Snowflake-Queue-Position"))
+		}
+		b, err := json.Marshal(reply)
+		if err != nil {
+			log.Printf("Error encoding websocket reply: %s", err.Error())
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			log.Printf("unable to write websocket reply with error: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Optional gzip compression of signaling messages. SDP offers with many ICE
+candidates can be several KB, so clients may compress their offers and proxies
+may ask for compressed poll responses. The messages package is unaware of this.
+
+The metrics endpoints, which are large and scraped often, are compressed with
+zstd or gzip for scrapers that accept either.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Reads at most readLimit bytes of the request body, decompressing it first if
+// it was sent with Content-Encoding: gzip. The limit applies to the
+// decompressed size, to guard against decompression bombs.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := http.MaxBytesReader(w, r.Body, readLimit)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return ioutil.ReadAll(body)
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(zr, readLimit+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > readLimit {
+			return nil, fmt.Errorf("decompressed body exceeds %d bytes", readLimit)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// Reports whether the request's Accept-Encoding header lists the content
+// coding, such as gzip.
+func acceptsEncoding(r *http.Request, contentCoding string) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != contentCoding {
+			continue
+		}
+		for _, param := range params[1:] {
+			if strings.Replace(param, " ", "", -1) == "q=0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Writes b as the whole response body in one write, with its Content-Length,
+// so that a client can tell a truncated response from a complete one. Unless
+// the header was already written, in which case the length is not sent.
+// Returns an error if b was not written in full.
+func writeFully(w http.ResponseWriter, b []byte) error {
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	n, err := w.Write(b)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// Writes b as the response body, gzip compressed if the request accepts it,
+// like writeFully.
+func writeResponseBody(w http.ResponseWriter, r *http.Request, b []byte) error {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(r, "gzip") {
+		return writeFully(w, b)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	return writeFully(w, buf.Bytes())
+}
+
+// Implements the http.ResponseWriter interface, compressing the body written
+// through it with the encoder newEncoder returns. The encoder, and with it the
+// headers, are only started once there is a body to write, so that responses
+// without one go out unchanged.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	contentCoding string
+	newEncoder    func(io.Writer) (io.WriteCloser, error)
+	encoder       io.WriteCloser
+	// Status set by the handler and not yet sent, or zero.
+	status      int
+	wroteHeader bool
+}
+
+func (ew *encodingResponseWriter) WriteHeader(status int) {
+	if ew.wroteHeader || ew.status != 0 {
+		return
+	}
+	ew.status = status
+}
+
+func (ew *encodingResponseWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if ew.encoder == nil {
+		if ew.wroteHeader {
+			return 0, errors.New("unable to start compressing response")
+		}
+		if err := ew.startEncoder(); err != nil {
+			return 0, err
+		}
+	}
+	return ew.encoder.Write(b)
+}
+
+func (ew *encodingResponseWriter) startEncoder() error {
+	ew.wroteHeader = true
+	encoder, err := ew.newEncoder(ew.ResponseWriter)
+	if err != nil {
+		ew.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	ew.encoder = encoder
+	// Any length set is that of the uncompressed body.
+	ew.Header().Del("Content-Length")
+	ew.Header().Set("Content-Encoding", ew.contentCoding)
+	status := ew.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ew.ResponseWriter.WriteHeader(status)
+	return nil
+}
+
+// Completes the response once the handler has returned: sends the status it
+// set if it wrote no body, or else the trailer of the compressed body.
+func (ew *encodingResponseWriter) finish() {
+	if ew.encoder == nil {
+		if !ew.wroteHeader && ew.status != 0 {
+			ew.ResponseWriter.WriteHeader(ew.status)
+		}
+		return
+	}
+	if err := ew.encoder.Close(); err != nil {
+		log.Printf("unable to compress response with error: %v", err)
+	}
+}
+
+// Returns a handler compressing the response bodies of handler with zstd, or
+// otherwise gzip, if the request accepts either. Responses to OPTIONS and HEAD
+// requests, which have no body, are never compressed.
+func compressedHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		ew := &encodingResponseWriter{ResponseWriter: w}
+		switch {
+		case acceptsEncoding(r, "zstd"):
+			ew.contentCoding = "zstd"
+			ew.newEncoder = func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+			}
+		case acceptsEncoding(r, "gzip"):
+			ew.contentCoding = "gzip"
+			ew.newEncoder = func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(w), nil
+			}
+		default:
+			handler.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
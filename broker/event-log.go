@@ -0,0 +1,72 @@
+/*
+Sampled log of match events, one JSON object per line, for offline analysis of
+how clients and proxies are matched. Events record only timestamps, NAT and
+proxy types, and outcomes: never addresses or proxy ids.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Events, by where they are recorded.
+const (
+	eventClientOffer = "client_offer"
+	eventProxyPoll   = "proxy_poll"
+	eventProxyAnswer = "proxy_answer"
+)
+
+type matchEvent struct {
+	// Rounded down to the second.
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ClientNAT string    `json:"client_nat,omitempty"`
+	ProxyNAT  string    `json:"proxy_nat,omitempty"`
+	ProxyType string    `json:"proxy_type,omitempty"`
+	Outcome   string    `json:"outcome"`
+}
+
+type eventLog struct {
+	lock   sync.Mutex
+	output io.Writer
+	// Fraction of events recorded, in (0, 1].
+	sampleRate float64
+	rand       *rand.Rand
+}
+
+func newEventLog(output io.Writer, sampleRate float64) *eventLog {
+	return &eventLog{
+		output:     output,
+		sampleRate: sampleRate,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Writes the event, if it is sampled. Does nothing on a nil eventLog, so that
+// callers need not check whether the log is enabled.
+func (l *eventLog) record(event matchEvent) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.sampleRate < 1 && l.rand.Float64() >= l.sampleRate {
+		return
+	}
+	event.Time = time.Now().UTC().Truncate(time.Second)
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding match event: %s", err.Error())
+		return
+	}
+	if _, err := l.output.Write(append(b, '\n')); err != nil {
+		log.Printf("unable to write match event with error: %v", err)
+	}
+}
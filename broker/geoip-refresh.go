@@ -0,0 +1,130 @@
+/*
+Periodic download of updated geoip databases, for brokers that can't have them
+installed by other means. Downloads go through a proxy if one is configured,
+and are checked before they replace the databases in use.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Largest geoip database that is downloaded.
+	geoipRefreshLimit = 64 * 1024 * 1024
+	// How long a download of both databases may take.
+	geoipRefreshTimeout = 5 * time.Minute
+)
+
+type geoipRefresher struct {
+	client *http.Client
+	// Base URL under which the databases are served as "geoip" and "geoip6".
+	url      string
+	geoipDB  string
+	geoip6DB string
+	metrics  *Metrics
+}
+
+// Returns a refresher downloading the databases at baseURL over paths geoipDB
+// and geoip6DB. Downloads go through proxyURL, an http, https, or socks5 URL,
+// if it is not empty, and otherwise through the proxy given by the
+// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables, if any.
+func newGeoipRefresher(baseURL, proxyURL string, geoipDB, geoip6DB string, metrics *Metrics) (*geoipRefresher, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid geoip refresh url: %v", err)
+	}
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geoip refresh proxy: %v", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	return &geoipRefresher{
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: proxy},
+			Timeout:   geoipRefreshTimeout,
+		},
+		url:      strings.TrimSuffix(baseURL, "/"),
+		geoipDB:  geoipDB,
+		geoip6DB: geoip6DB,
+		metrics:  metrics,
+	}, nil
+}
+
+// Refreshes the databases every interval, forever.
+func (g *geoipRefresher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := g.refresh(); err != nil {
+			log.Printf("geoip refresh failed, keeping the old databases: %v", err)
+		}
+	}
+}
+
+// Downloads both databases and, if both parse, replaces the files in use with
+// them and loads them. Otherwise the old databases are left in place.
+func (g *geoipRefresher) refresh() error {
+	geoipTemp, err := g.download(g.url+"/geoip", g.geoipDB, new(GeoIPv4Table))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(geoipTemp)
+	geoip6Temp, err := g.download(g.url+"/geoip6", g.geoip6DB, new(GeoIPv6Table))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(geoip6Temp)
+
+	if err := os.Rename(geoipTemp, g.geoipDB); err != nil {
+		return err
+	}
+	if err := os.Rename(geoip6Temp, g.geoip6DB); err != nil {
+		return err
+	}
+
+	g.metrics.lock.Lock()
+	defer g.metrics.lock.Unlock()
+	return g.metrics.LoadGeoipDatabases(g.geoipDB, g.geoip6DB)
+}
+
+// Downloads a database to a temporary file next to pathname, so that it can be
+// renamed over it, and checks that it parses into table. Returns the name of
+// the temporary file.
+func (g *geoipRefresher) download(dbURL string, pathname string, table GeoIPTable) (string, error) {
+	resp, err := g.client.Get(dbURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s returned status %s", dbURL, resp.Status)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(pathname), "."+filepath.Base(pathname)+".")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, io.LimitReader(resp.Body, geoipRefreshLimit))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = GeoIPLoadFile(table, f.Name())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("fetching %s: %v", dbURL, err)
+	}
+	return f.Name(), nil
+}
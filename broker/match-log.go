@@ -0,0 +1,85 @@
+/*
+Logging of match decisions at the debug log level, one line for each
+snowflake chosen for a client, saying which heap it came from, where it stood
+in it, and why it was chosen. Lines carry no client addresses, only prefixes of
+proxy ids, and are scrubbed even when the main log is not.
+*/
+
+package broker
+
+import (
+	"strings"
+)
+
+// Log levels, of which only LogLevelDebug logs match decisions.
+const (
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
+// Names the heap in match decisions. The caller must hold snowflakeLock.
+func (ctx *BrokerContext) heapName(snowflakeHeap *SnowflakeHeap) string {
+	switch snowflakeHeap {
+	case ctx.snowflakes:
+		return "unrestricted"
+	case ctx.restrictedSnowflakes:
+		return "restricted"
+	case ctx.prioritySnowflakes:
+		return "priority_unrestricted"
+	case ctx.priorityRestrictedSnowflakes:
+		return "priority_restricted"
+	default:
+		return "unknown"
+	}
+}
+
+// Returns how many of the snowflakes left in snowflakeHeap the match strategy
+// would have taken before snowflake, which was just taken out of it, had the
+// client not preferred a proxy type or region. The caller must hold
+// snowflakeLock.
+func (ctx *BrokerContext) heapPosition(snowflakeHeap *SnowflakeHeap, snowflake *Snowflake) int {
+	position := 0
+	for _, other := range *snowflakeHeap {
+		if ctx.matchStrategy == MatchRoundRobin {
+			if other.seq < snowflake.seq {
+				position++
+			}
+		} else if other.before(snowflake) {
+			position++
+		}
+	}
+	return position
+}
+
+// Logs, at the debug level, that snowflake was just taken out of snowflakeHeap
+// for a client of clientNAT, because of the reasons given. The caller must
+// hold snowflakeLock.
+func (ctx *BrokerContext) logMatch(clientNAT string, snowflakeHeap *SnowflakeHeap, snowflake *Snowflake, reasons []string) {
+	if ctx.matchLog == nil || snowflake == nil {
+		return
+	}
+	id := snowflake.id
+	if len(id) > heapIDPrefixLength {
+		id = id[:heapIDPrefixLength]
+	}
+	ctx.matchLog.Printf("match: client_nat=%s heap=%s proxy=%s proxy_type=%s proxy_nat=%s clients=%d position=%d/%d reason=%s",
+		clientNAT, ctx.heapName(snowflakeHeap), id, snowflake.proxyType, snowflake.natType,
+		snowflake.clients, ctx.heapPosition(snowflakeHeap, snowflake), snowflakeHeap.Len()+1,
+		strings.Join(reasons, ","))
+}
+
+// Returns the reasons a snowflake taken by popSnowflake was chosen: the match
+// strategy, and the proxy type and region the client preferred if it has them.
+func (ctx *BrokerContext) matchReasons(snowflake *Snowflake, proxyType string, region string) []string {
+	reasons := []string{MatchLeastLoaded}
+	if ctx.matchStrategy == MatchRoundRobin {
+		reasons[0] = MatchRoundRobin
+	}
+	if proxyType != "" && snowflake.proxyType == proxyType {
+		reasons = append(reasons, "proxy_type")
+	}
+	if region != "" && snowflake.region == region {
+		reasons = append(reasons, "region")
+	}
+	return reasons
+}
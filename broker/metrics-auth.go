@@ -0,0 +1,60 @@
+/*
+Optional HTTP basic authentication of the metrics endpoints, which otherwise
+show the broker's operational data to anyone. The password is configured as a
+bcrypt hash, so that the configuration does not hold it.
+*/
+
+package broker
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type basicAuthCredentials struct {
+	user     string
+	passHash []byte
+}
+
+// Parses credentials of the form user:passhash, where passhash is the bcrypt
+// hash of the password, as made by htpasswd -B.
+func parseBasicAuthCredentials(s string) (*basicAuthCredentials, error) {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return nil, fmt.Errorf("credentials are not of the form user:passhash")
+	}
+	if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+		return nil, fmt.Errorf("invalid password hash: %v", err)
+	}
+	return &basicAuthCredentials{user: fields[0], passHash: []byte(fields[1])}, nil
+}
+
+// Implements the http.Handler interface, passing on only requests with HTTP
+// basic authentication matching credentials, and answering others with 401.
+type BasicAuthHandler struct {
+	handler     http.Handler
+	credentials *basicAuthCredentials
+	realm       string
+}
+
+func NewBasicAuthHandler(handler http.Handler, credentials *basicAuthCredentials, realm string) *BasicAuthHandler {
+	return &BasicAuthHandler{handler: handler, credentials: credentials, realm: realm}
+}
+
+func (bh *BasicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	// The password is checked even for the wrong user, so that how long the
+	// check takes does not tell whether the user was right.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(bh.credentials.user)) == 1
+	passOK := bcrypt.CompareHashAndPassword(bh.credentials.passHash, []byte(pass)) == nil
+	if !ok || !userOK || !passOK {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", bh.realm))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	bh.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,48 @@
+/*
+The destination of the metrics log, which is line buffered and can be flushed
+to stable storage so that no lines are lost when the broker shuts down.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sync"
+)
+
+type metricsFile struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newMetricsFile(file *os.File) *metricsFile {
+	return &metricsFile{file: file, writer: bufio.NewWriter(file)}
+}
+
+// Buffers p, writing out the buffer whenever it ends a line.
+func (mf *metricsFile) Write(p []byte) (int, error) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	n, err := mf.writer.Write(p)
+	if err == nil && bytes.HasSuffix(p, []byte("\n")) {
+		err = mf.writer.Flush()
+	}
+	return n, err
+}
+
+// Writes out anything buffered and commits the file to stable storage. The
+// latter is skipped for os.Stdout, which may well not be a file.
+func (mf *metricsFile) Sync() error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if err := mf.writer.Flush(); err != nil {
+		return err
+	}
+	if mf.file == os.Stdout {
+		return nil
+	}
+	return mf.file.Sync()
+}
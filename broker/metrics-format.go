@@ -0,0 +1,88 @@
+/*
+Formats for the lines written to the metrics log.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// One key and value of the periodic metrics report, such as
+// "snowflake-ips-total" and 5.
+type MetricsEntry struct {
+	Key   string
+	Value interface{}
+}
+
+// Renders a metrics report as the lines to write to the metrics log.
+type MetricsFormatter interface {
+	Format(entries []MetricsEntry) []string
+}
+
+// The format of the broker spec: one "key value" line per entry.
+type TextMetricsFormatter struct{}
+
+func (TextMetricsFormatter) Format(entries []MetricsEntry) []string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		lines = append(lines, fmt.Sprint(entry.Key, " ", entry.Value))
+	}
+	return lines
+}
+
+// One "key,value" CSV record per entry.
+type CSVMetricsFormatter struct{}
+
+func (CSVMetricsFormatter) Format(entries []MetricsEntry) []string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		// Writing to a bytes.Buffer cannot fail.
+		w.Write([]string{entry.Key, fmt.Sprint(entry.Value)})
+		w.Flush()
+		lines = append(lines, strings.TrimSuffix(buf.String(), "\n"))
+	}
+	return lines
+}
+
+// A single JSON object per report, with the keys in report order.
+type JSONMetricsFormatter struct{}
+
+func (JSONMetricsFormatter) Format(entries []MetricsEntry) []string {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range entries {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry.Key)
+		value, err := json.Marshal(entry.Value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(entry.Value))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return []string{buf.String()}
+}
+
+// Returns the formatter for the name given to --metrics-format.
+func NewMetricsFormatter(name string) (MetricsFormatter, error) {
+	switch name {
+	case "", "text":
+		return TextMetricsFormatter{}, nil
+	case "csv":
+		return CSVMetricsFormatter{}, nil
+	case "json":
+		return JSONMetricsFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown metrics format %q", name)
+}
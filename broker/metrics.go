@@ -20,6 +20,12 @@ import (
 const (
 	prometheusNamespace = "snowflake"
 	metricsResolution   = 60 * 60 * 24 * time.Second //86400 seconds
+
+	// Weight of each new sample in the moving average of client roundtrips.
+	clientRoundtripWeight = 0.2
+	// Number of countries with the most proxies given their own series of the
+	// proxies_by_country gauge, the rest being added up under "other".
+	proxyCountryLimit = 20
 )
 
 type CountryStats struct {
@@ -37,9 +43,10 @@ type CountryStats struct {
 
 // Implements Observable
 type Metrics struct {
-	logger  *log.Logger
-	tablev4 *GeoIPv4Table
-	tablev6 *GeoIPv6Table
+	logger    *log.Logger
+	formatter MetricsFormatter
+	tablev4   *GeoIPv4Table
+	tablev6   *GeoIPv6Table
 
 	countryStats                  CountryStats
 	clientRoundtripEstimate       time.Duration
@@ -48,6 +55,18 @@ type Metrics struct {
 	clientRestrictedDeniedCount   uint
 	clientUnrestrictedDeniedCount uint
 	clientProxyMatchCount         uint
+	// Longest a client waited in the queue before being handed a snowflake,
+	// since the metrics were last zeroed.
+	clientQueueMaxWait time.Duration
+
+	// NAT types proxies last registered with, by proxy id
+	natHistory *natHistory
+
+	// Numbers of proxies polling, by country, and the countries exported
+	// by the proxies_by_country gauge out of at most countryLimit of them.
+	liveProxies       map[string]int
+	exportedCountries map[string]bool
+	countryLimit      int
 
 	// synchronization for access to snowflake metrics
 	lock sync.Mutex
@@ -114,22 +133,9 @@ func (m *Metrics) UpdateCountryStats(addr string, proxyType string, natType stri
 		}
 	}
 
-	ip := net.ParseIP(addr)
-	if ip.To4() != nil {
-		//This is an IPv4 address
-		if m.tablev4 == nil {
-			return
-		}
-		country, ok = GetCountryByAddr(m.tablev4, ip)
-	} else {
-		if m.tablev6 == nil {
-			return
-		}
-		country, ok = GetCountryByAddr(m.tablev6, ip)
-	}
-
+	country, ok = m.GetCountry(addr)
 	if !ok {
-		country = "??"
+		return
 	}
 
 	//update map of unique ips and counts
@@ -161,24 +167,131 @@ func (m *Metrics) UpdateCountryStats(addr string, proxyType string, natType stri
 
 }
 
+// Records the NAT type a proxy registered with, counting a transition if it
+// differs from the one it last registered with.
+func (m *Metrics) UpdateNATHistory(id string, natType string) {
+	previous, ok := m.natHistory.Update(id, natType)
+	if ok && previous != natType {
+		m.promMetrics.ProxyNATTransitionTotal.With(prometheus.Labels{
+			"from": previous,
+			"to":   natType,
+		}).Inc()
+	}
+}
+
+// Folds a matched client's roundtrip into clientRoundtripEstimate, an
+// exponentially weighted moving average. The caller must hold m.lock.
+func (m *Metrics) UpdateClientRoundtrip(roundtrip time.Duration) {
+	if m.clientRoundtripEstimate == 0 {
+		m.clientRoundtripEstimate = roundtrip
+	} else {
+		m.clientRoundtripEstimate += time.Duration(clientRoundtripWeight *
+			float64(roundtrip-m.clientRoundtripEstimate))
+	}
+	m.promMetrics.ClientRoundtripEstimate.Set(m.clientRoundtripEstimate.Seconds())
+}
+
+// Records how long a client waited in the queue before being handed a
+// snowflake, keeping the longest wait. The caller must hold m.lock.
+func (m *Metrics) UpdateClientQueueWait(wait time.Duration) {
+	if wait > m.clientQueueMaxWait {
+		m.clientQueueMaxWait = wait
+		m.promMetrics.ClientQueueMaxWait.Set(wait.Seconds())
+	}
+}
+
+// Looks up the country code of addr, returning "??" if it is not in the geoip
+// database. Returns false if no geoip database is loaded for addr's family.
+func (m *Metrics) GetCountry(addr string) (string, bool) {
+	var country string
+	var ok bool
+
+	ip := net.ParseIP(addr)
+	if ip.To4() != nil {
+		//This is an IPv4 address
+		if m.tablev4 == nil {
+			return "", false
+		}
+		country, ok = GetCountryByAddr(m.tablev4, ip)
+	} else {
+		if m.tablev6 == nil {
+			return "", false
+		}
+		country, ok = GetCountryByAddr(m.tablev6, ip)
+	}
+
+	if !ok {
+		country = "??"
+	}
+	return country, true
+}
+
+// Counts a proxy at addr as polling, until RemoveLiveProxy is called with the
+// country returned. The caller must hold the lock.
+func (m *Metrics) AddLiveProxy(addr string) string {
+	country, ok := m.GetCountry(addr)
+	if !ok {
+		country = "??"
+	}
+	m.liveProxies[country]++
+	m.updateProxiesByCountry()
+	return country
+}
+
+// Stops counting a proxy of the country as polling. The caller must hold the
+// lock.
+func (m *Metrics) RemoveLiveProxy(country string) {
+	if m.liveProxies[country]--; m.liveProxies[country] <= 0 {
+		delete(m.liveProxies, country)
+	}
+	m.updateProxiesByCountry()
+}
+
+// Sets the proxies_by_country gauge to the numbers of proxies polling from
+// each of the countryLimit countries with the most of them, and to the total
+// of the rest for "other", so that the gauge has boundedly many series.
+func (m *Metrics) updateProxiesByCountry() {
+	rs := records{}
+	for cc, count := range m.liveProxies {
+		rs = append(rs, record{cc: cc, count: count})
+	}
+	sort.Sort(sort.Reverse(rs))
+
+	exported := make(map[string]bool)
+	other := 0
+	for i, r := range rs {
+		if i < m.countryLimit {
+			exported[r.cc] = true
+			m.promMetrics.ProxiesByCountry.With(prometheus.Labels{"cc": r.cc}).Set(float64(r.count))
+		} else {
+			other += r.count
+		}
+	}
+	for cc := range m.exportedCountries {
+		if !exported[cc] {
+			m.promMetrics.ProxiesByCountry.Delete(prometheus.Labels{"cc": cc})
+		}
+	}
+	m.exportedCountries = exported
+	m.promMetrics.ProxiesByCountry.With(prometheus.Labels{"cc": "other"}).Set(float64(other))
+}
+
 func (m *Metrics) LoadGeoipDatabases(geoipDB string, geoip6DB string) error {
 
 	// Load geoip databases
 	log.Println("Loading geoip databases")
+	// Keep the old databases unless both new ones load.
 	tablev4 := new(GeoIPv4Table)
 	err := GeoIPLoadFile(tablev4, geoipDB)
 	if err != nil {
-		m.tablev4 = nil
 		return err
 	}
-	m.tablev4 = tablev4
-
 	tablev6 := new(GeoIPv6Table)
 	err = GeoIPLoadFile(tablev6, geoip6DB)
 	if err != nil {
-		m.tablev6 = nil
 		return err
 	}
+	m.tablev4 = tablev4
 	m.tablev6 = tablev6
 	return nil
 }
@@ -197,7 +310,12 @@ func NewMetrics(metricsLogger *log.Logger) (*Metrics, error) {
 		natUnknown:      make(map[string]bool),
 	}
 
+	m.natHistory = newNATHistory(natHistorySize)
+	m.liveProxies = make(map[string]int)
+	m.exportedCountries = make(map[string]bool)
+	m.countryLimit = proxyCountryLimit
 	m.logger = metricsLogger
+	m.formatter = TextMetricsFormatter{}
 	m.promMetrics = initPrometheus()
 
 	// Write to log file every hour with updated metrics
@@ -217,21 +335,37 @@ func (m *Metrics) logMetrics() {
 
 func (m *Metrics) printMetrics() {
 	m.lock.Lock()
-	m.logger.Println("snowflake-stats-end", time.Now().UTC().Format("2006-01-02 15:04:05"), fmt.Sprintf("(%d s)", int(metricsResolution.Seconds())))
-	m.logger.Println("snowflake-ips", m.countryStats.Display())
-	m.logger.Println("snowflake-ips-total", len(m.countryStats.standalone)+
-		len(m.countryStats.badge)+len(m.countryStats.webext)+len(m.countryStats.unknown))
-	m.logger.Println("snowflake-ips-standalone", len(m.countryStats.standalone))
-	m.logger.Println("snowflake-ips-badge", len(m.countryStats.badge))
-	m.logger.Println("snowflake-ips-webext", len(m.countryStats.webext))
-	m.logger.Println("snowflake-idle-count", binCount(m.proxyIdleCount))
-	m.logger.Println("client-denied-count", binCount(m.clientDeniedCount))
-	m.logger.Println("client-restricted-denied-count", binCount(m.clientRestrictedDeniedCount))
-	m.logger.Println("client-unrestricted-denied-count", binCount(m.clientUnrestrictedDeniedCount))
-	m.logger.Println("client-snowflake-match-count", binCount(m.clientProxyMatchCount))
-	m.logger.Println("snowflake-ips-nat-restricted", len(m.countryStats.natRestricted))
-	m.logger.Println("snowflake-ips-nat-unrestricted", len(m.countryStats.natUnrestricted))
-	m.logger.Println("snowflake-ips-nat-unknown", len(m.countryStats.natUnknown))
+	for _, line := range m.formatter.Format(m.metricsEntries()) {
+		m.logger.Println(line)
+	}
+	m.lock.Unlock()
+}
+
+// Returns the current metrics report. The caller must hold m.lock.
+func (m *Metrics) metricsEntries() []MetricsEntry {
+	return []MetricsEntry{
+		{"snowflake-stats-end", time.Now().UTC().Format("2006-01-02 15:04:05") + fmt.Sprintf(" (%d s)", int(metricsResolution.Seconds()))},
+		{"snowflake-ips", m.countryStats.Display()},
+		{"snowflake-ips-total", len(m.countryStats.standalone) +
+			len(m.countryStats.badge) + len(m.countryStats.webext) + len(m.countryStats.unknown)},
+		{"snowflake-ips-standalone", len(m.countryStats.standalone)},
+		{"snowflake-ips-badge", len(m.countryStats.badge)},
+		{"snowflake-ips-webext", len(m.countryStats.webext)},
+		{"snowflake-idle-count", binCount(m.proxyIdleCount)},
+		{"client-denied-count", binCount(m.clientDeniedCount)},
+		{"client-restricted-denied-count", binCount(m.clientRestrictedDeniedCount)},
+		{"client-unrestricted-denied-count", binCount(m.clientUnrestrictedDeniedCount)},
+		{"client-snowflake-match-count", binCount(m.clientProxyMatchCount)},
+		{"snowflake-ips-nat-restricted", len(m.countryStats.natRestricted)},
+		{"snowflake-ips-nat-unrestricted", len(m.countryStats.natUnrestricted)},
+		{"snowflake-ips-nat-unknown", len(m.countryStats.natUnknown)},
+	}
+}
+
+// Sets the format of the lines written to the metrics log.
+func (m *Metrics) SetFormatter(formatter MetricsFormatter) {
+	m.lock.Lock()
+	m.formatter = formatter
 	m.lock.Unlock()
 }
 
@@ -242,6 +376,8 @@ func (m *Metrics) zeroMetrics() {
 	m.clientRestrictedDeniedCount = 0
 	m.clientUnrestrictedDeniedCount = 0
 	m.clientProxyMatchCount = 0
+	m.clientQueueMaxWait = 0
+	m.promMetrics.ClientQueueMaxWait.Set(0)
 	m.countryStats.counts = make(map[string]int)
 	m.countryStats.standalone = make(map[string]bool)
 	m.countryStats.badge = make(map[string]bool)
@@ -263,6 +399,65 @@ type PromMetrics struct {
 	ProxyPollTotal   *RoundedCounterVec
 	ClientPollTotal  *RoundedCounterVec
 	AvailableProxies *prometheus.GaugeVec
+	ProxiesByCountry *prometheus.GaugeVec
+
+	ClientDeniedByCountry *RoundedCounterVec
+	ClientMatchTotal      *RoundedCounterVec
+	MalformedRequestTotal *prometheus.CounterVec
+	// Proxy polls that failed to decode, by the field at fault.
+	PollDecodeFailTotal *prometheus.CounterVec
+
+	ProxyNATTransitionTotal   *prometheus.CounterVec
+	ProxyNATRedetectTotal     prometheus.Counter
+	AnswerRetryTotal          prometheus.Counter
+	AnswerDeliverTimeoutTotal prometheus.Counter
+	ProxyConnectionOutcome    *prometheus.CounterVec
+	MatchGoroutines           prometheus.Gauge
+	ProxyIdleDuration         prometheus.Histogram
+	ProxyAnswerLatency        *prometheus.HistogramVec
+	ProxyLoad                 prometheus.Histogram
+	ClientRoundtripEstimate   prometheus.Gauge
+	ClientQueueMaxWait        prometheus.Gauge
+	ClientEmptyHeapTotal      prometheus.Counter
+	ProxyTypeRejectedTotal    prometheus.Counter
+	ProxyLifetimeRefusedTotal prometheus.Counter
+	AnswerUnknownIDTotal      prometheus.Counter
+	// Client offers turned away for the limit on offers in flight.
+	ClientInflightRejectedTotal prometheus.Counter
+	// Proxy polls answered as idle because the Broker loop didn't take them
+	// in time.
+	ProxyPollBackpressureTotal prometheus.Counter
+	// Offers and answers that could not be written in full to the proxy or
+	// client, by endpoint.
+	ResponseWriteErrorTotal *prometheus.CounterVec
+	// Requests mirrored to the shadow broker, by endpoint and whether they
+	// were forwarded, failed, or dropped.
+	ShadowRequestTotal *prometheus.CounterVec
+	// Proxy polls by the region the proxy declared, or "none".
+	ProxyPollRegionTotal *prometheus.CounterVec
+	// Proxy ids quarantined for failing to answer, and the polls refused for
+	// it.
+	ProxyQuarantinedTotal       prometheus.Counter
+	ProxyQuarantineRefusedTotal prometheus.Counter
+	// Proxy timeout last used for a poll, when it adapts to client arrivals.
+	EffectiveProxyTimeout prometheus.Gauge
+	// Proxies whose last poll is older than the staleness threshold.
+	StaleProxies prometheus.Gauge
+	// Restricted clients matched with a restricted proxy for want of an
+	// unrestricted one, by outcome.
+	ClientRestrictedFallbackTotal *prometheus.CounterVec
+	// Client offers shed because matches are slow.
+	ClientShedTotal prometheus.Counter
+	// Client offers turned away for the per-client rate limit.
+	ClientRateLimitedTotal prometheus.Counter
+	// Client offers without a known NAT type, by whether the header was
+	// missing, "unknown", or invalid.
+	ClientUnknownNATTotal *prometheus.CounterVec
+	// Proxies forgotten for the cap on proxies tracked at once.
+	EvictedStaleProxyTotal prometheus.Counter
+	// Snowflakes repaired by the audit of the heaps, by kind of
+	// inconsistency.
+	InconsistencyRepairedTotal *prometheus.CounterVec
 }
 
 // Initialize metrics for prometheus exporter
@@ -302,15 +497,332 @@ func initPrometheus() *PromMetrics {
 		prometheus.CounterOpts{
 			Namespace: prometheusNamespace,
 			Name:      "rounded_client_poll_total",
-			Help:      "The number of snowflake client polls, rounded up to a multiple of 8",
+			Help:      "The number of snowflake client polls, by the NAT type of the proxy matched, rounded up to a multiple of 8",
 		},
-		[]string{"nat", "status"},
+		[]string{"nat", "proxy_nat", "status", "transport"},
+	)
+
+	promMetrics.ClientDeniedByCountry = NewRoundedCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rounded_client_denied_by_country_total",
+			Help:      "The number of snowflake client polls denied for lack of proxies, by client country, rounded up to a multiple of 8",
+		},
+		[]string{"cc"},
+	)
+
+	promMetrics.ClientMatchTotal = NewRoundedCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rounded_client_match_total",
+			Help:      "The number of snowflake client offers by client country and whether they were matched, denied, or timed out waiting for an answer, rounded up to a multiple of 8",
+		},
+		[]string{"cc", "status"},
+	)
+
+	promMetrics.MalformedRequestTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "malformed_request_total",
+			Help:      "The number of requests rejected as malformed, by endpoint and reason",
+		},
+		[]string{"endpoint", "reason"},
+	)
+
+	promMetrics.PollDecodeFailTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "poll_decode_fail_total",
+			Help:      "The number of proxy polls that failed to decode, or whose unknown NAT type was taken as unknown, by the field at fault",
+		},
+		[]string{"field"},
+	)
+
+	promMetrics.ProxyNATTransitionTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_nat_transition_total",
+			Help:      "The number of times a proxy registered with a different NAT type than before",
+		},
+		[]string{"from", "to"},
+	)
+
+	promMetrics.ProxyNATRedetectTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_nat_redetect_total",
+			Help:      "The number of polls asking a proxy whose matches kept failing to detect its NAT type again",
+		},
+	)
+
+	promMetrics.AnswerRetryTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "answer_retry_total",
+			Help:      "The number of times handing a proxy's answer to its client was retried",
+		},
+	)
+
+	promMetrics.AnswerDeliverTimeoutTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "answer_deliver_timeout_total",
+			Help:      "The number of proxy answers abandoned because their client did not take them within the answer deliver timeout",
+		},
+	)
+
+	promMetrics.ProxyConnectionOutcome = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_connection_outcome_total",
+			Help:      "The number of proxy connections with clients acknowledged by the proxies, by whether they succeeded",
+		},
+		[]string{"status"},
+	)
+
+	promMetrics.MatchGoroutines = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "match_goroutines",
+			Help:      "The number of goroutines waiting to pass a client offer to a polling proxy",
+		},
+	)
+
+	promMetrics.ProxyIdleDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_idle_duration_seconds",
+			Help:      "How long snowflake proxy polls that timed out without a client waited",
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 8),
+		},
+	)
+
+	promMetrics.ProxyLoad = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_load",
+			Help:      "The load of snowflake proxies relative to their capacity, including the fraction of it they reported in use, as they left the pool",
+			Buckets:   []float64{0, 0.25, 0.5, 0.75, 1, 2, 4},
+		},
+	)
+
+	promMetrics.ProxyAnswerLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_answer_latency_seconds",
+			Help:      "How long snowflake proxies took to answer a client offer, or were waited for if they did not",
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 8),
+		},
+		[]string{"status"},
+	)
+
+	promMetrics.ClientRoundtripEstimate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_roundtrip_estimate_seconds",
+			Help:      "Moving average of how long matched snowflake clients waited for an answer",
+		},
+	)
+
+	promMetrics.ClientQueueMaxWait = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_queue_max_wait_seconds",
+			Help:      "The longest a snowflake client waited in the queue before being handed a proxy, over the current metrics period",
+		},
+	)
+
+	promMetrics.ClientEmptyHeapTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_empty_heap_total",
+			Help:      "The number of client offers that found no snowflake to take after seeing one available, which should not happen",
+		},
+	)
+
+	promMetrics.ProxyTypeRejectedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_type_rejected_total",
+			Help:      "The number of proxy polls rejected for a proxy type that is not allowed",
+		},
+	)
+
+	promMetrics.ProxyLifetimeRefusedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_lifetime_refused_total",
+			Help:      "The number of proxy polls refused for an id registering for longer than the maximum proxy lifetime",
+		},
+	)
+
+	promMetrics.AnswerUnknownIDTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "answer_unknown_id_total",
+			Help:      "The number of well-formed proxy answers for an id that is no longer known, typically because its client gave up",
+		},
+	)
+
+	promMetrics.ClientInflightRejectedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_inflight_rejected_total",
+			Help:      "The number of client offers rejected because the maximum number of offers were already in flight",
+		},
+	)
+
+	promMetrics.ResponseWriteErrorTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "response_write_error_total",
+			Help:      "The number of offers sent to proxies and answers sent to clients that could not be written in full",
+		},
+		[]string{"endpoint"},
+	)
+
+	promMetrics.ShadowRequestTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "shadow_request_total",
+			Help:      "The number of client offers and proxy polls mirrored to the shadow broker, by whether they were forwarded, failed, or dropped",
+		},
+		[]string{"endpoint", "status"},
+	)
+
+	promMetrics.ProxyPollRegionTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_poll_region_total",
+			Help:      "The number of proxy polls, by the allowed region the proxy declared",
+		},
+		[]string{"region"},
+	)
+
+	promMetrics.ProxyQuarantinedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_quarantined_total",
+			Help:      "The number of times a proxy id was quarantined for failing to answer the clients it was matched with",
+		},
+	)
+
+	promMetrics.ProxyQuarantineRefusedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_quarantine_refused_total",
+			Help:      "The number of proxy polls refused because the proxy id is quarantined",
+		},
+	)
+
+	promMetrics.EffectiveProxyTimeout = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "effective_proxy_timeout_seconds",
+			Help:      "The proxy timeout, adapted to the rate at which clients arrive, last given to a proxy poll",
+		},
+	)
+
+	promMetrics.StaleProxies = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "stale_proxies",
+			Help:      "The number of proxies that have not polled within the staleness threshold",
+		},
+	)
+
+	promMetrics.ClientRestrictedFallbackTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_restricted_fallback_total",
+			Help:      "The number of restricted clients matched with a restricted proxy because no unrestricted proxy was available, by outcome",
+		},
+		[]string{"status"},
+	)
+
+	promMetrics.ProxyPollBackpressureTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxy_poll_backpressure_total",
+			Help:      "The number of proxy polls answered as idle because the broker loop did not take them in time",
+		},
+	)
+
+	promMetrics.ClientRateLimitedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_rate_limited_total",
+			Help:      "The number of client offers turned away because the client made too many offers a minute",
+		},
+	)
+
+	promMetrics.ClientShedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_shed_total",
+			Help:      "The number of client offers shed because the client roundtrip estimate was above the shedding threshold",
+		},
+	)
+
+	promMetrics.InconsistencyRepairedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "inconsistency_repaired_total",
+			Help:      "The number of snowflakes whose heap and id map entries the audit found out of step and repaired",
+		},
+		[]string{"kind"},
+	)
+
+	promMetrics.ClientUnknownNATTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "client_unknown_nat_total",
+			Help:      "The number of client offers without a known NAT type, by the Snowflake-NAT-Type header they sent",
+		},
+		[]string{"header"},
+	)
+
+	promMetrics.EvictedStaleProxyTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "evicted_stale_proxy_total",
+			Help:      "The number of proxies forgotten because the maximum number of proxies were already tracked",
+		},
+	)
+
+	promMetrics.ProxiesByCountry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "proxies_by_country",
+			Help:      "The number of snowflake proxies polling, by the countries with the most and the rest as other",
+		},
+		[]string{"cc"},
 	)
 
 	// We need to register our metrics so they can be exported.
 	promMetrics.registry.MustRegister(
 		promMetrics.ClientPollTotal, promMetrics.ProxyPollTotal,
-		promMetrics.ProxyTotal, promMetrics.AvailableProxies,
+		promMetrics.ProxyTotal, promMetrics.AvailableProxies, promMetrics.ProxiesByCountry,
+		promMetrics.ClientDeniedByCountry, promMetrics.ClientMatchTotal,
+		promMetrics.MalformedRequestTotal, promMetrics.PollDecodeFailTotal,
+		promMetrics.ProxyNATTransitionTotal, promMetrics.ProxyNATRedetectTotal,
+		promMetrics.AnswerRetryTotal, promMetrics.AnswerDeliverTimeoutTotal,
+		promMetrics.ProxyConnectionOutcome,
+		promMetrics.MatchGoroutines, promMetrics.ProxyIdleDuration,
+		promMetrics.ProxyAnswerLatency, promMetrics.ProxyLoad,
+		promMetrics.ClientRoundtripEstimate, promMetrics.ClientQueueMaxWait,
+		promMetrics.ClientEmptyHeapTotal,
+		promMetrics.ProxyTypeRejectedTotal, promMetrics.ProxyLifetimeRefusedTotal,
+		promMetrics.AnswerUnknownIDTotal, promMetrics.ClientInflightRejectedTotal,
+		promMetrics.ProxyPollBackpressureTotal, promMetrics.EvictedStaleProxyTotal,
+		promMetrics.ResponseWriteErrorTotal, promMetrics.ShadowRequestTotal,
+		promMetrics.ClientShedTotal, promMetrics.ClientUnknownNATTotal,
+		promMetrics.ClientRateLimitedTotal, promMetrics.ProxyPollRegionTotal,
+		promMetrics.EffectiveProxyTimeout,
+		promMetrics.StaleProxies,
+		promMetrics.ClientRestrictedFallbackTotal,
+		promMetrics.ProxyQuarantinedTotal, promMetrics.ProxyQuarantineRefusedTotal,
+		promMetrics.InconsistencyRepairedTotal,
 	)
 
 	return promMetrics
@@ -0,0 +1,107 @@
+/*
+HTTP middleware applied to all of the broker's handlers.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Wraps an http.ResponseWriter to remember the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Lets WebSocket connections be upgraded through the recorder.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Implements the http.Handler interface, logging the method, path, status,
+// duration, and remote address of each handled request. The logger's output
+// should scrub IP addresses, since the remote address is logged as is.
+type AccessLogHandler struct {
+	handler http.Handler
+	logger  *log.Logger
+}
+
+func NewAccessLogHandler(handler http.Handler, logger *log.Logger) *AccessLogHandler {
+	return &AccessLogHandler{handler: handler, logger: logger}
+}
+
+func (ah *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	ah.handler.ServeHTTP(sr, r)
+	ah.logger.Printf("%s %s %s %d %s", r.RemoteAddr, r.Method, r.URL.Path, sr.status, time.Since(start))
+}
+
+// Paths of the signaling endpoints, whose responses must never be cached.
+var signalingPaths = map[string]bool{
+	"/proxy":            true,
+	"/proxy/deregister": true,
+	"/proxy/ack":        true,
+	"/client":           true,
+	"/client/ws":        true,
+	"/answer":           true,
+	"/status":           true,
+}
+
+// Implements the http.Handler interface, setting security related headers on
+// every response before passing the request on.
+type SecurityHeadersHandler struct {
+	handler http.Handler
+}
+
+func NewSecurityHeadersHandler(handler http.Handler) *SecurityHeadersHandler {
+	return &SecurityHeadersHandler{handler: handler}
+}
+
+func (sh *SecurityHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if signalingPaths[r.URL.Path] {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	if r.URL.Path == "/debug" {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	}
+	sh.handler.ServeHTTP(w, r)
+}
+
+// Implements the http.Handler interface, rejecting requests from blocklisted
+// remote addresses with 403 before passing the rest on.
+type BlocklistHandler struct {
+	handler   http.Handler
+	blocklist *Blocklist
+}
+
+func NewBlocklistHandler(handler http.Handler, blocklist *Blocklist) *BlocklistHandler {
+	return &BlocklistHandler{handler: handler, blocklist: blocklist}
+}
+
+func (bh *BlocklistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && bh.blocklist.Contains(ip) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	bh.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,57 @@
+/*
+Bounded record of the NAT type each proxy last registered with, so that
+changes between polls can be counted.
+*/
+
+package broker
+
+import (
+	"container/list"
+)
+
+// Maximum number of proxy ids remembered; the least recently seen are
+// forgotten first.
+const natHistorySize = 10000
+
+type natHistoryEntry struct {
+	id      string
+	natType string
+}
+
+// An LRU cache mapping proxy ids to NAT types. Not safe for concurrent use.
+type natHistory struct {
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newNATHistory(size int) *natHistory {
+	return &natHistory{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Records natType for id, returning the NAT type previously recorded for it
+// and whether there was one.
+func (h *natHistory) Update(id string, natType string) (string, bool) {
+	if elem, ok := h.entries[id]; ok {
+		entry := elem.Value.(*natHistoryEntry)
+		previous := entry.natType
+		entry.natType = natType
+		h.order.MoveToFront(elem)
+		return previous, true
+	}
+	h.entries[id] = h.order.PushFront(&natHistoryEntry{id: id, natType: natType})
+	if h.order.Len() > h.size {
+		oldest := h.order.Back()
+		h.order.Remove(oldest)
+		delete(h.entries, oldest.Value.(*natHistoryEntry).id)
+	}
+	return "", false
+}
+
+func (h *natHistory) Len() int {
+	return h.order.Len()
+}
@@ -0,0 +1,81 @@
+/*
+Tracking of proxies whose matches keep failing, which may be because the NAT
+type they registered with is stale, so that their next poll can ask them to
+detect it again.
+*/
+
+package broker
+
+import (
+	"sync"
+)
+
+type natRedetectEntry struct {
+	// NAT type the proxy was matched with.
+	natType string
+	// Failed matches in a row while of natType.
+	failures int
+}
+
+type natRedetection struct {
+	lock sync.Mutex
+	// Failed matches in a row after which a proxy is asked to redetect its
+	// NAT type, or never if zero.
+	threshold int
+	entries   map[string]*natRedetectEntry
+}
+
+// Records that the proxy id, registered as natType, did not answer the client
+// it was matched with.
+func (n *natRedetection) fail(id string, natType string) {
+	if n.threshold <= 0 {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.entries == nil {
+		n.entries = make(map[string]*natRedetectEntry)
+	}
+	entry, ok := n.entries[id]
+	if !ok || entry.natType != natType {
+		// Proxies beyond the bound are not asked to redetect.
+		if !ok && len(n.entries) >= natHistorySize {
+			return
+		}
+		entry = &natRedetectEntry{natType: natType}
+		n.entries[id] = entry
+	}
+	entry.failures++
+}
+
+// Records that the proxy id answered its client, so that its earlier failures
+// no longer count.
+func (n *natRedetection) succeed(id string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.entries, id)
+}
+
+// Returns whether the proxy id, polling as natType, should be asked to
+// redetect its NAT type. A proxy polling with a NAT type other than the one
+// it failed with has already done so, and its failures are forgotten, as they
+// are once it has been asked.
+func (n *natRedetection) poll(id string, natType string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	entry, ok := n.entries[id]
+	if !ok {
+		return false
+	}
+	if entry.natType != natType {
+		delete(n.entries, id)
+		return false
+	}
+	if n.threshold <= 0 || entry.failures < n.threshold {
+		return false
+	}
+	delete(n.entries, id)
+	return true
+}
@@ -6,9 +6,11 @@ counts of users and proxies
 package broker
 
 import (
+	"net/http"
 	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/protobuf/proto"
 )
@@ -81,3 +83,61 @@ func (v *RoundedCounterVec) With(labels prometheus.Labels) RoundedCounter {
 	}
 	return metric.(RoundedCounter)
 }
+
+// Gathers only the metrics of a Gatherer that carry all of the given labels
+// with the given values, dropping families left with none
+type filteredGatherer struct {
+	gatherer prometheus.Gatherer
+	labels   map[string]string
+}
+
+// Implements the prometheus.Gatherer interface
+func (g filteredGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	var filtered []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.Metric {
+			if g.matches(metric) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered, err
+}
+
+func (g filteredGatherer) matches(metric *dto.Metric) bool {
+	matched := 0
+	for _, pair := range metric.Label {
+		if value, ok := g.labels[pair.GetName()]; ok {
+			if pair.GetValue() != value {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(g.labels)
+}
+
+// Serves the metrics of gatherer, limited to those whose labels match the
+// query parameters, if any, so that ?nat=restricted gives only the series
+// labelled with the restricted NAT type. The response is not compressed, which
+// is left to compressedHandler.
+func filteredMetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if len(query) == 0 {
+			promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{DisableCompression: true}).ServeHTTP(w, r)
+			return
+		}
+		labels := make(map[string]string)
+		for name := range query {
+			labels[name] = query.Get(name)
+		}
+		promhttp.HandlerFor(filteredGatherer{gatherer, labels}, promhttp.HandlerOpts{DisableCompression: true}).ServeHTTP(w, r)
+	})
+}
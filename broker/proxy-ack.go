@@ -0,0 +1,112 @@
+/*
+Acknowledgements from proxies of whether their connections with the clients
+they answered succeeded, so that the broker learns which proxies actually
+connect rather than only which ones answer.
+*/
+
+package broker
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/RACECAR-GU/snowflake/common/messages"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// How long after its answer was delivered a proxy may acknowledge the
+	// outcome of its connection. Proxies give up on a client after 20
+	// seconds.
+	ackWindow = 1 * time.Minute
+	// Most proxies awaiting acknowledgement at once; the answers of others
+	// delivered meanwhile are not tracked.
+	maxPendingAcks = 10000
+)
+
+// The proxy ids whose answers were delivered within the last ackWindow.
+type pendingAcks struct {
+	lock      sync.Mutex
+	delivered map[string]time.Time
+	// When to next forget the ids whose window has passed.
+	nextSweep time.Time
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+}
+
+func (p *pendingAcks) currentTime() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// Records that the answer of the proxy id was delivered to its client.
+func (p *pendingAcks) add(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.currentTime()
+	if p.delivered == nil {
+		p.delivered = make(map[string]time.Time)
+	}
+	if now.After(p.nextSweep) {
+		for pendingID, delivered := range p.delivered {
+			if now.Sub(delivered) > ackWindow {
+				delete(p.delivered, pendingID)
+			}
+		}
+		p.nextSweep = now.Add(ackWindow)
+	}
+	if len(p.delivered) >= maxPendingAcks {
+		return
+	}
+	p.delivered[id] = now
+}
+
+// Forgets the proxy id, returning whether its answer was delivered within the
+// last ackWindow.
+func (p *pendingAcks) take(id string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delivered, ok := p.delivered[id]
+	if !ok {
+		return false
+	}
+	delete(p.delivered, id)
+	return p.currentTime().Sub(delivered) <= ackWindow
+}
+
+/*
+For snowflake proxies to report whether the connection with the client whose
+offer they answered succeeded. Each delivered answer may be acknowledged once.
+*/
+func proxyAck(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if err != nil {
+		log.Println("Invalid data.")
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "ack", "reason": "unreadable"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sid, status, err := messages.DecodeAckRequest(body)
+	if err != nil {
+		ctx.metrics.promMetrics.MalformedRequestTotal.With(prometheus.Labels{"endpoint": "ack", "reason": "undecodable"}).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !ctx.pendingAcks.take(sid) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ctx.metrics.promMetrics.ProxyConnectionOutcome.With(prometheus.Labels{"status": status}).Inc()
+	if ctx.qualityMatching {
+		ctx.proxyQuality.record(sid, status == messages.AckSuccess)
+	}
+}
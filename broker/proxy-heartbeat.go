@@ -0,0 +1,91 @@
+/*
+Tracking of when each proxy id last polled, so that proxies going quiet show
+up in the metrics as stale, rather than only disappearing once their last
+poll times out.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Most proxy ids whose last polls are tracked at once; others polling
+	// meanwhile are not counted.
+	maxHeartbeatEntries = 10000
+	// Multiple of the staleness threshold after which a silent proxy is
+	// forgotten, and no longer counted as stale.
+	heartbeatForgetFactor = 10
+)
+
+type proxyHeartbeats struct {
+	lock sync.Mutex
+	// Time since its last poll after which a proxy counts as stale, or zero
+	// not to track polls.
+	staleAfter time.Duration
+	lastPoll   map[string]time.Time
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+}
+
+func (h *proxyHeartbeats) currentTime() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+// Records that the proxy id polled.
+func (h *proxyHeartbeats) poll(id string) {
+	if h.staleAfter <= 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.lastPoll == nil {
+		h.lastPoll = make(map[string]time.Time)
+	}
+	if _, ok := h.lastPoll[id]; !ok && len(h.lastPoll) >= maxHeartbeatEntries {
+		return
+	}
+	h.lastPoll[id] = h.currentTime()
+}
+
+// Returns the number of proxy ids whose last poll is older than staleAfter,
+// forgetting those silent for heartbeatForgetFactor times as long.
+func (h *proxyHeartbeats) stale() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.currentTime()
+	stale := 0
+	for id, last := range h.lastPoll {
+		silent := now.Sub(last)
+		if silent > heartbeatForgetFactor*h.staleAfter {
+			delete(h.lastPoll, id)
+		} else if silent > h.staleAfter {
+			stale++
+		}
+	}
+	return stale
+}
+
+// Sets the stale proxies gauge to the proxies of the broker and its pools
+// gone quiet.
+func (ctx *BrokerContext) updateStaleProxies() {
+	stale := ctx.proxyHeartbeats.stale()
+	for _, pool := range ctx.vhostPools {
+		stale += pool.proxyHeartbeats.stale()
+	}
+	ctx.metrics.promMetrics.StaleProxies.Set(float64(stale))
+}
+
+// Updates the stale proxies gauge every interval, forever.
+func (ctx *BrokerContext) updateStaleProxiesEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx.updateStaleProxies()
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Aging out of proxy ids that keep re-registering, such as those of bots, which
+are refused for a cooldown once they have been seen for longer than the
+maximum proxy lifetime.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+type proxyLifetimes struct {
+	lock sync.Mutex
+	// How long an id may keep registering after it was first seen, or
+	// forever if zero, and for how long it is then refused.
+	maxLifetime time.Duration
+	cooldown    time.Duration
+	firstSeen   map[string]time.Time
+	// When to next forget the ids whose cooldown has passed.
+	nextSweep time.Time
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+}
+
+// Records that the proxy id is registering, returning false if it has been
+// seen for longer than maxLifetime and is still in its cooldown. Once the
+// cooldown has passed, the id is treated as if seen for the first time.
+func (p *proxyLifetimes) allow(id string) bool {
+	if p.maxLifetime <= 0 {
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	if p.firstSeen == nil {
+		p.firstSeen = make(map[string]time.Time)
+	}
+	if now.After(p.nextSweep) {
+		for seenID, first := range p.firstSeen {
+			if now.Sub(first) >= p.maxLifetime+p.cooldown {
+				delete(p.firstSeen, seenID)
+			}
+		}
+		p.nextSweep = now.Add(p.cooldown)
+	}
+
+	first, ok := p.firstSeen[id]
+	switch age := now.Sub(first); {
+	case !ok || age >= p.maxLifetime+p.cooldown:
+		p.firstSeen[id] = now
+		return true
+	case age <= p.maxLifetime:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Estimates, from their acknowledgements, how often the connections of proxies
+succeed, so that proxies that usually connect can be preferred over those that
+usually don't.
+*/
+
+package broker
+
+import (
+	"sync"
+)
+
+const (
+	// Success rate assumed of a proxy that has not acknowledged a connection.
+	neutralQuality = 0.5
+	// Weight of each acknowledgement in a proxy's success rate, the rest
+	// being its rate before.
+	qualityWeight = 0.2
+	// Most proxies whose success rates are tracked at once; those beyond are
+	// given neutralQuality.
+	maxProxyQualities = 10000
+)
+
+// Exponentially weighted moving averages of the success rates of proxies, by
+// id.
+type proxyQuality struct {
+	lock  sync.Mutex
+	rates map[string]float64
+}
+
+// Records whether a connection of the proxy id succeeded.
+func (q *proxyQuality) record(id string, success bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.rates == nil {
+		q.rates = make(map[string]float64)
+	}
+	rate, ok := q.rates[id]
+	if !ok {
+		if len(q.rates) >= maxProxyQualities {
+			return
+		}
+		rate = neutralQuality
+	}
+	outcome := 0.0
+	if success {
+		outcome = 1
+	}
+	q.rates[id] = (1-qualityWeight)*rate + qualityWeight*outcome
+}
+
+// Returns the estimated success rate of the proxy id, in [0, 1].
+func (q *proxyQuality) rate(id string) float64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if rate, ok := q.rates[id]; ok {
+		return rate
+	}
+	return neutralQuality
+}
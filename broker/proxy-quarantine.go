@@ -0,0 +1,111 @@
+/*
+Quarantine of proxy ids that keep being handed client offers without
+answering them in time, which wastes the clients' matches. Such an id is
+refused for a cooldown once it has failed often enough within a window.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// Most proxy ids with failed answers tracked at once; others failing
+// meanwhile are not quarantined.
+const maxQuarantineEntries = 10000
+
+type quarantineEntry struct {
+	// When the first of the failures counted happened.
+	windowStart time.Time
+	failures    int
+	// Until when the id is refused, or zero if it is not.
+	until time.Time
+}
+
+type proxyQuarantine struct {
+	lock sync.Mutex
+	// Failed answers within window after which an id is refused for
+	// cooldown, or never if threshold is zero.
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	entries   map[string]*quarantineEntry
+	// When to next forget the entries whose window and cooldown have passed.
+	nextSweep time.Time
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+}
+
+func (q *proxyQuarantine) currentTime() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// Records that the proxy id did not answer the client it was matched with in
+// time, returning true if this puts it in quarantine.
+func (q *proxyQuarantine) fail(id string) bool {
+	if q.threshold <= 0 {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := q.currentTime()
+	if q.entries == nil {
+		q.entries = make(map[string]*quarantineEntry)
+	}
+	if now.After(q.nextSweep) {
+		for failedID, entry := range q.entries {
+			if now.Sub(entry.windowStart) > q.window && !now.Before(entry.until) {
+				delete(q.entries, failedID)
+			}
+		}
+		q.nextSweep = now.Add(q.window)
+	}
+
+	entry, ok := q.entries[id]
+	if !ok {
+		if len(q.entries) >= maxQuarantineEntries {
+			return false
+		}
+		entry = &quarantineEntry{}
+		q.entries[id] = entry
+	}
+	if now.Before(entry.until) {
+		return false
+	}
+	if entry.failures == 0 || now.Sub(entry.windowStart) > q.window {
+		entry.windowStart = now
+		entry.failures = 0
+	}
+	entry.failures++
+	if entry.failures < q.threshold {
+		return false
+	}
+	entry.until = now.Add(q.cooldown)
+	entry.failures = 0
+	return true
+}
+
+// Records that the proxy id answered its client, so that its earlier failures
+// no longer count.
+func (q *proxyQuarantine) succeed(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if entry, ok := q.entries[id]; ok && !q.currentTime().Before(entry.until) {
+		delete(q.entries, id)
+	}
+}
+
+// Returns whether the proxy id is in quarantine.
+func (q *proxyQuarantine) quarantined(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry, ok := q.entries[id]
+	return ok && q.currentTime().Before(entry.until)
+}
@@ -0,0 +1,97 @@
+/*
+A proxy timeout that adapts to the rate at which clients arrive, so that
+proxies are sent back to poll again quickly while clients are plentiful, and
+kept available longer while they are scarce.
+*/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of each new interval between client arrivals in their moving
+	// average.
+	clientArrivalWeight = 0.1
+	// Client arrivals a proxy waits through, on average, before timing out,
+	// since other proxies may be ahead of it in the heap.
+	adaptiveTimeoutArrivals = 10
+)
+
+// The rate at which client offers arrive.
+type clientArrivals struct {
+	lock sync.Mutex
+	last time.Time
+	// Moving average of the time between arrivals, zero until two have
+	// arrived.
+	interval time.Duration
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+}
+
+func (a *clientArrivals) currentTime() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// Records the arrival of a client offer.
+func (a *clientArrivals) arrive() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := a.currentTime()
+	if !a.last.IsZero() {
+		gap := now.Sub(a.last)
+		if a.interval == 0 {
+			a.interval = gap
+		} else {
+			a.interval += time.Duration(clientArrivalWeight * float64(gap-a.interval))
+		}
+	}
+	a.last = now
+}
+
+// Returns the average time between client arrivals, or the time since the
+// last one if longer, so that the estimate grows while none arrive. Returns
+// false if too few clients have arrived to tell.
+func (a *clientArrivals) averageInterval() (time.Duration, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.interval == 0 {
+		return 0, false
+	}
+	interval := a.interval
+	if since := a.currentTime().Sub(a.last); since > interval {
+		interval = since
+	}
+	return interval, true
+}
+
+// Returns how long a proxy that did not ask for a wait of its own waits for
+// an offer, before jitter. That is proxyTimeout, unless the timeout adapts, in
+// which case it is the time for adaptiveTimeoutArrivals clients to arrive,
+// bounded by minAdaptiveProxyTimeout and maxAdaptiveProxyTimeout, or the
+// proxy timeout if that is zero.
+func (ctx *BrokerContext) effectiveProxyTimeout() time.Duration {
+	if ctx.minAdaptiveProxyTimeout <= 0 {
+		return ctx.proxyTimeout
+	}
+	max := ctx.maxAdaptiveProxyTimeout
+	if max <= 0 {
+		max = ctx.proxyTimeout
+	}
+	timeout := max
+	if interval, ok := ctx.clientArrivals.averageInterval(); ok && adaptiveTimeoutArrivals*interval < max {
+		timeout = adaptiveTimeoutArrivals * interval
+	}
+	if timeout < ctx.minAdaptiveProxyTimeout {
+		timeout = ctx.minAdaptiveProxyTimeout
+	}
+	ctx.metrics.promMetrics.EffectiveProxyTimeout.Set(timeout.Seconds())
+	return timeout
+}
@@ -0,0 +1,40 @@
+/*
+Regions or datacenters that proxies declare themselves in, among those the
+broker allows, so that proxies can be counted by region and, when matching by
+region, be preferred for the clients that ask for theirs.
+*/
+
+package broker
+
+import (
+	"net/http"
+)
+
+// Region metric label of proxies that declared no allowed region.
+const noRegion = "none"
+
+// Returns region if it is among the regions allowed, and "" otherwise.
+func (ctx *BrokerContext) allowedRegion(region string) string {
+	if !ctx.allowedRegions[region] {
+		return ""
+	}
+	return region
+}
+
+// Returns the allowed region the client asks to be matched in with the
+// Snowflake-Region header, or "" if it asks for none or regions are not
+// matched.
+func (ctx *BrokerContext) clientRegion(r *http.Request) string {
+	if !ctx.regionMatching {
+		return ""
+	}
+	return ctx.allowedRegion(r.Header.Get("Snowflake-Region"))
+}
+
+// Returns the label of region in the region metric.
+func regionLabel(region string) string {
+	if region == "" {
+		return noRegion
+	}
+	return region
+}
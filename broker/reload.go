@@ -0,0 +1,147 @@
+/*
+Reloading of the configuration read from files, on SIGHUP, so that operators
+can update the geoip databases, blocklist, admin token, proxy tiers, and
+allowed proxy types without restarting the broker. A source that fails to
+reload keeps its old value.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Reads a file of proxy types, one per line, ignoring blank lines and those
+// starting with '#', and returns them as a set.
+func loadProxyTypes(filename string) (map[string]bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	proxyTypes := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		proxyTypes[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(proxyTypes) == 0 {
+		return nil, fmt.Errorf("allowed proxy types file %q is empty", filename)
+	}
+	return proxyTypes, nil
+}
+
+// Reads the admin token from filename, which must not be empty.
+func loadAdminToken(filename string) (string, error) {
+	token, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	adminToken := strings.TrimSpace(string(token))
+	if adminToken == "" {
+		return "", fmt.Errorf("admin token file %q is empty", filename)
+	}
+	return adminToken, nil
+}
+
+// Reloads the configuration on each signal received on sigChan, then calls
+// reloaded, if it is not nil.
+func (ctx *BrokerContext) reloadOnSignal(sigChan <-chan os.Signal, cfg Config, blocklist *Blocklist, reloaded func()) {
+	for signal := range sigChan {
+		log.Printf("Received signal: %s. Reloading configuration.", signal)
+		ctx.reload(cfg, blocklist)
+		if reloaded != nil {
+			reloaded()
+		}
+	}
+}
+
+// Reloads each source of configuration in cfg that is read from a file, and
+// blocklist if it is not nil, and returns a summary of the outcome for each,
+// such as "blocklist: changed" or "proxy tiers: failed (...)". A source that
+// fails to reload keeps its old value.
+func (ctx *BrokerContext) reload(cfg Config, blocklist *Blocklist) []string {
+	var summary []string
+	report := func(source string, changed bool, err error) {
+		switch {
+		case err != nil:
+			log.Printf("reload of %s returned error, keeping the old one: %v", source, err)
+			summary = append(summary, fmt.Sprintf("%s: failed (%v)", source, err))
+		case changed:
+			summary = append(summary, source+": changed")
+		default:
+			summary = append(summary, source+": unchanged")
+		}
+	}
+
+	if !cfg.DisableGeoip {
+		ctx.metrics.lock.Lock()
+		err := ctx.metrics.LoadGeoipDatabases(cfg.GeoipDatabase, cfg.Geoip6Database)
+		ctx.metrics.lock.Unlock()
+		// The databases are too large to compare, so count them as changed.
+		report("geoip databases", true, err)
+	}
+
+	if blocklist != nil {
+		oldV4, oldV6 := blocklist.tries()
+		err := blocklist.Load(cfg.BlocklistFile)
+		v4, v6 := blocklist.tries()
+		report("blocklist", !reflect.DeepEqual(v4, oldV4) || !reflect.DeepEqual(v6, oldV6), err)
+	}
+
+	if cfg.AdminTokenFile != "" {
+		adminToken, err := loadAdminToken(cfg.AdminTokenFile)
+		changed := false
+		if err == nil {
+			ctx.reloadLock.Lock()
+			changed = adminToken != ctx.adminToken
+			ctx.adminToken = adminToken
+			ctx.reloadLock.Unlock()
+		}
+		report("admin token", changed, err)
+	}
+
+	if cfg.ProxyTiersFile != "" {
+		proxyTiers, err := loadProxyTiers(cfg.ProxyTiersFile)
+		changed := false
+		if err == nil {
+			ctx.reloadLock.Lock()
+			changed = !reflect.DeepEqual(proxyTiers, ctx.proxyTiers)
+			ctx.proxyTiers = proxyTiers
+			ctx.reloadLock.Unlock()
+		}
+		report("proxy tiers", changed, err)
+	}
+
+	if cfg.AllowedProxyTypesFile != "" {
+		allowedProxyTypes, err := loadProxyTypes(cfg.AllowedProxyTypesFile)
+		changed := false
+		if err == nil {
+			ctx.reloadLock.Lock()
+			changed = !reflect.DeepEqual(allowedProxyTypes, ctx.allowedProxyTypes)
+			ctx.allowedProxyTypes = allowedProxyTypes
+			ctx.reloadLock.Unlock()
+		}
+		report("allowed proxy types", changed, err)
+	}
+
+	for _, pool := range ctx.vhostPools {
+		ctx.copyReloadable(pool)
+	}
+
+	log.Printf("Reloaded configuration: %s", strings.Join(summary, ", "))
+	return summary
+}
@@ -0,0 +1,54 @@
+/*
+Cheap checks of client offers and proxy answers, catching broken clients and
+proxies before their SDP is passed on. The SDP is otherwise opaque to the
+broker.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Longest envelope tag accepted on an offer or answer.
+const maxEncodingTagLength = 64
+
+// Reports whether the SDP of an offer or answer has a DTLS fingerprint and at
+// least one media section, without which the peers could not connect. The
+// description is JSON-serialized, or bare SDP.
+func hasSDPFingerprint(description []byte) bool {
+	sdp := string(description)
+	var desc struct {
+		SDP string `json:"sdp"`
+	}
+	if err := json.Unmarshal(description, &desc); err == nil {
+		sdp = desc.SDP
+	}
+
+	var fingerprint, media bool
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		fingerprint = fingerprint || strings.HasPrefix(line, "a=fingerprint:")
+		media = media || strings.HasPrefix(line, "m=")
+	}
+	return fingerprint && media
+}
+
+// Reports whether tag, naming the envelope an offer or answer is wrapped in,
+// such as "v1;scheme=x25519", is short and made only of the characters such
+// tags are written with. The envelope itself is not inspected.
+func validEncodingTag(tag string) bool {
+	if len(tag) == 0 || len(tag) > maxEncodingTagLength {
+		return false
+	}
+	for _, c := range tag {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case strings.ContainsRune("+-./;=_", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+/*
+A self-test of the matching pipeline, for smoke testing a broker build without
+exposing it to real clients and proxies.
+*/
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	selfTestTimeout = 5 * time.Second
+	selfTestID      = "snowflake-self-test"
+	selfTestOffer   = "self-test offer"
+	selfTestAnswer  = "self-test answer"
+)
+
+// Drives a synthetic proxy and client through the snowflake heap and the offer
+// and answer channels, as the handlers do but without their checks, metrics,
+// or mirroring to a shadow broker, so that the core of matching can be smoke
+// tested whatever the configuration. Returns an error describing the first
+// step that did not complete.
+func (ctx *BrokerContext) SelfTest() error {
+	snowflake := ctx.AddSnowflake(selfTestID, "standalone", NATUnrestricted)
+	defer ctx.forgetSnowflakes([]*Snowflake{snowflake})
+
+	// The synthetic proxy answers the offer it is sent.
+	go func() {
+		offer, ok := <-snowflake.offerChannel
+		if ok && offer != nil && string(offer.sdp) == selfTestOffer {
+			snowflake.answerChannel <- []byte(selfTestAnswer)
+		}
+	}()
+
+	ctx.snowflakeLock.Lock()
+	taken := ctx.heapFor(snowflake).Remove(snowflake)
+	ctx.snowflakeLock.Unlock()
+	if !taken {
+		close(snowflake.offerChannel)
+		return fmt.Errorf("proxy was not registered")
+	}
+
+	snowflake.offerChannel <- &ClientOffer{
+		natType:  NATRestricted,
+		sdp:      []byte(selfTestOffer),
+		received: time.Now(),
+		context:  context.Background(),
+	}
+	answerer, answer := ctx.waitForAnswer([]*Snowflake{snowflake}, selfTestTimeout, nil)
+	if answerer == nil {
+		return fmt.Errorf("proxy did not answer")
+	}
+	if string(answer) != selfTestAnswer {
+		return fmt.Errorf("client received answer %q", answer)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Mirroring of client offers and proxy polls to a shadow broker, such as a
+standby, so that it can be tried under the shape of real traffic without
+affecting clients. Only metadata is forwarded: offers are sent without their
+SDP or session ids, and polls under ids hashed with a key of this process.
+Requests are sent asynchronously, and their responses discarded.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/RACECAR-GU/snowflake/common/messages"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Most requests in flight to the shadow broker at once, beyond which
+	// further ones are dropped.
+	maxShadowRequests = 100
+	// Longest a request to the shadow broker may take, which must allow for
+	// the shadow's own proxy timeout.
+	shadowRequestTimeout = 1 * time.Minute
+	// Bytes of the hash in the ids of proxies at the shadow, which encode to
+	// 16 characters like the ids proxies make up themselves.
+	shadowProxyIDLength = 12
+)
+
+// Client offer headers forwarded to the shadow broker.
+var shadowClientHeaders = []string{
+	"Snowflake-NAT-Type",
+	"Snowflake-Proxy-Type-Preference",
+	"Snowflake-Priority",
+	"Snowflake-Region",
+	"Snowflake-Client-Timeout",
+}
+
+type shadowBroker struct {
+	url        *url.URL
+	httpClient *http.Client
+	slots      chan struct{}
+	// Key with which proxy ids are hashed, so that a proxy keeps one id at
+	// the shadow that cannot be mapped back to its own.
+	key []byte
+}
+
+func newShadowBroker(shadowURL string) (*shadowBroker, error) {
+	u, err := url.Parse(shadowURL)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &shadowBroker{
+		url:        u,
+		httpClient: &http.Client{Timeout: shadowRequestTimeout},
+		slots:      make(chan struct{}, maxShadowRequests),
+		key:        key,
+	}, nil
+}
+
+// Returns the id under which the proxy with session id sid polls the shadow.
+func (s *shadowBroker) proxyID(sid string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:shadowProxyIDLength])
+}
+
+// Posts body to path at the shadow broker in the background, or drops it if
+// too many requests are in flight already. Does nothing if the shadow is not
+// configured.
+func (ctx *BrokerContext) shadowPost(path string, header http.Header, body []byte) {
+	s := ctx.shadow
+	if s == nil {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		ctx.metrics.promMetrics.ShadowRequestTotal.With(prometheus.Labels{"endpoint": path, "status": "dropped"}).Inc()
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		endpoint := s.url.ResolveReference(&url.URL{Path: path})
+		req, err := http.NewRequest("POST", endpoint.String(), bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error making shadow request: %s", err.Error())
+			return
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			ctx.metrics.promMetrics.ShadowRequestTotal.With(prometheus.Labels{"endpoint": path, "status": "failed"}).Inc()
+			return
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, readLimit))
+		resp.Body.Close()
+		ctx.metrics.promMetrics.ShadowRequestTotal.With(prometheus.Labels{"endpoint": path, "status": "forwarded"}).Inc()
+	}()
+}
+
+// Mirrors the metadata of the client offer r to the shadow broker.
+func (ctx *BrokerContext) shadowClientOffer(r *http.Request) {
+	if ctx.shadow == nil {
+		return
+	}
+	header := make(http.Header)
+	for _, name := range shadowClientHeaders {
+		if value := r.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	ctx.shadowPost("client", header, nil)
+}
+
+// Mirrors a poll by the proxy with session id sid to the shadow broker.
+func (ctx *BrokerContext) shadowProxyPoll(sid, proxyType, natType string) {
+	if ctx.shadow == nil {
+		return
+	}
+	body, err := messages.EncodePollRequest(ctx.shadow.proxyID(sid), proxyType, natType)
+	if err != nil {
+		log.Printf("Error encoding shadow poll: %s", err.Error())
+		return
+	}
+	ctx.shadowPost("proxy", nil, body)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package broker
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that put the broker into draining mode.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,8 @@
+package broker
+
+import (
+	"os"
+)
+
+// Signals that put the broker into draining mode. Windows has no SIGUSR1.
+var drainSignals []os.Signal
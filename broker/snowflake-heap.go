@@ -4,6 +4,14 @@ Keeping track of pending available snowflake proxies.
 
 package broker
 
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 /*
 The Snowflake struct contains a single interaction
 over the offer and answer channels.
@@ -16,6 +24,72 @@ type Snowflake struct {
 	answerChannel chan []byte
 	clients       int
 	index         int
+	seq           uint64 // order in which the snowflake was added
+	added         time.Time
+	tier          string // empty unless a trusted proxy polled with a tier
+	region        string // empty unless the proxy declared an allowed region
+	// Relative capacity of the proxy, by which its client count is divided
+	// to compare its load with others'. Treated as 1 if zero.
+	weight float64
+	// Fraction of its capacity in use that the proxy reported, in [0, 1],
+	// counted as part of a client. Zero if it reported none.
+	reportedLoad float64
+	// Estimated chance that a connection of the proxy fails, counted as part
+	// of a client when matching by quality. Zero otherwise.
+	unreliability float64
+	// When the snowflake was handed a client offer, guarded by snowflakeLock.
+	offerSent time.Time
+	// Tag of the envelope the proxy's answer is wrapped in, if any, guarded
+	// by snowflakeLock.
+	answerEncoding string
+	// Closed once the client the snowflake was handed no longer waits, or
+	// the match deadline has passed, guarded by snowflakeLock.
+	matchDone <-chan struct{}
+	// Set once the client matched with the snowflake no longer waits for its
+	// answer, guarded by snowflakeLock.
+	clientGone bool
+}
+
+// Returns the number of clients of the snowflake, plus the load it reported,
+// relative to its capacity.
+func (s *Snowflake) load() float64 {
+	clients := float64(s.clients) + s.reportedLoad
+	if s.weight <= 0 {
+		return clients
+	}
+	return clients / s.weight
+}
+
+// Returns whether the snowflake sorts before other when matching by load.
+// Snowflakes serving less clients for their capacity sort earlier, and of
+// those, the ones more likely to connect, then the ones added earliest, so
+// that proxies of equal load are matched in a well defined order.
+func (s *Snowflake) before(other *Snowflake) bool {
+	if p, q := s.load()+s.unreliability, other.load()+other.unreliability; p != q {
+		return p < q
+	}
+	return s.seq < other.seq
+}
+
+// Parses a comma-separated list of proxyType=weight pairs, such as
+// "standalone=4,webext=1", into a map. Weights must be positive.
+func parseProxyTypeWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	if s == "" {
+		return weights, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid proxy type weight %q", pair)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight for proxy type %q: %q", fields[0], fields[1])
+		}
+		weights[fields[0]] = weight
+	}
+	return weights, nil
 }
 
 // Implements heap.Interface, and holds Snowflakes.
@@ -24,8 +98,7 @@ type SnowflakeHeap []*Snowflake
 func (sh SnowflakeHeap) Len() int { return len(sh) }
 
 func (sh SnowflakeHeap) Less(i, j int) bool {
-	// Snowflakes serving less clients should sort earlier.
-	return sh[i].clients < sh[j].clients
+	return sh[i].before(sh[j])
 }
 
 func (sh SnowflakeHeap) Swap(i, j int) {
@@ -50,3 +123,90 @@ func (sh *SnowflakeHeap) Pop() interface{} {
 	*sh = flakes[0 : n-1]
 	return snowflake
 }
+
+// Removes the snowflake from the heap in O(log n), by its index. Returns false,
+// leaving the heap unchanged, if the snowflake is not in the heap, which
+// includes a snowflake whose index is stale.
+func (sh *SnowflakeHeap) Remove(snowflake *Snowflake) bool {
+	i := snowflake.index
+	if i < 0 || i >= sh.Len() || (*sh)[i] != snowflake {
+		return false
+	}
+	heap.Remove(sh, i)
+	return true
+}
+
+// Removes and returns the highest priority Snowflake of the given proxy type.
+// Falls back to the highest priority Snowflake of any type if none match or
+// proxyType is empty. Returns nil if the heap is empty.
+func (sh *SnowflakeHeap) PopPreferred(proxyType string) *Snowflake {
+	return sh.PopPreferredInRegion(proxyType, "")
+}
+
+// Like PopPreferred, but preferring among the Snowflakes of the given proxy
+// type, or of any type if none match, those in region if not empty.
+func (sh *SnowflakeHeap) PopPreferredInRegion(proxyType string, region string) *Snowflake {
+	if sh.Len() == 0 {
+		return nil
+	}
+	if proxyType != "" || region != "" {
+		if snowflake := sh.popFirst(proxyType, region, sh.Less, true); snowflake != nil {
+			return snowflake
+		}
+	}
+	// Without a match to look for, the heap already keeps the least loaded
+	// snowflake first.
+	return heap.Pop(sh).(*Snowflake)
+}
+
+// Removes and returns the Snowflake of the given proxy type that was added
+// earliest, regardless of load, so that successive calls cycle through the
+// available proxies in the order they polled. Falls back to proxies of any type
+// like PopPreferred. Returns nil if the heap is empty.
+func (sh *SnowflakeHeap) PopOldest(proxyType string) *Snowflake {
+	return sh.PopOldestInRegion(proxyType, "")
+}
+
+// Like PopOldest, but preferring those in region if not empty, like
+// PopPreferredInRegion.
+func (sh *SnowflakeHeap) PopOldestInRegion(proxyType string, region string) *Snowflake {
+	return sh.popFirst(proxyType, region, func(i, j int) bool {
+		return (*sh)[i].seq < (*sh)[j].seq
+	}, false)
+}
+
+// Removes and returns the Snowflake that sorts first according to less among
+// those of the given proxy type, or among all of them if there are none, and
+// of those, among the ones in region if there are any. If matchingOnly, returns
+// nil instead of falling back to Snowflakes of neither the proxy type nor the
+// region.
+func (sh *SnowflakeHeap) popFirst(proxyType string, region string, less func(i, j int) bool, matchingOnly bool) *Snowflake {
+	if sh.Len() == 0 {
+		return nil
+	}
+	// A matching proxy type outranks a matching region.
+	rank := func(snowflake *Snowflake) int {
+		r := 0
+		if proxyType != "" && snowflake.proxyType == proxyType {
+			r += 2
+		}
+		if region != "" && snowflake.region == region {
+			r++
+		}
+		return r
+	}
+	best, bestRank := -1, 0
+	for i, snowflake := range *sh {
+		r := rank(snowflake)
+		if matchingOnly && r == 0 {
+			continue
+		}
+		if best == -1 || r > bestRank || (r == bestRank && less(i, best)) {
+			best, bestRank = i, r
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	return heap.Remove(sh, best).(*Snowflake)
+}
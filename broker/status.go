@@ -0,0 +1,82 @@
+/*
+A lightweight endpoint for clients to check proxy availability before sending
+an offer, so that they can back off rather than be denied.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a /status response is reused before the heaps are read again.
+	statusCacheTTL = 1 * time.Second
+)
+
+type statusResponse struct {
+	Unrestricted int `json:"unrestricted"`
+	Restricted   int `json:"restricted"`
+	// Moving average of how long matched clients waited for an answer, once
+	// any have been matched.
+	ClientRoundtripMs int64 `json:"client_roundtrip_ms,omitempty"`
+}
+
+// Caches the encoded /status response so that heavy polling does not contend
+// for snowflakeLock.
+type statusCache struct {
+	lock    sync.Mutex
+	body    []byte
+	expires time.Time
+}
+
+// Returns the encoded /status response, reading the heap lengths again if the
+// cached response has expired.
+func (ctx *BrokerContext) statusBody() ([]byte, error) {
+	ctx.statusCache.lock.Lock()
+	defer ctx.statusCache.lock.Unlock()
+
+	now := time.Now()
+	if ctx.statusCache.body != nil && now.Before(ctx.statusCache.expires) {
+		return ctx.statusCache.body, nil
+	}
+
+	var status statusResponse
+	ctx.snowflakeLock.Lock()
+	status.Unrestricted = ctx.snowflakes.Len()
+	status.Restricted = ctx.restrictedSnowflakes.Len()
+	ctx.snowflakeLock.Unlock()
+	ctx.metrics.lock.Lock()
+	status.ClientRoundtripMs = int64(ctx.metrics.clientRoundtripEstimate / time.Millisecond)
+	ctx.metrics.lock.Unlock()
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	ctx.statusCache.body = body
+	ctx.statusCache.expires = now.Add(statusCacheTTL)
+	return body, nil
+}
+
+/*
+Reports the number of unrestricted and restricted snowflake proxies currently
+available to clients, and how long matched clients have lately waited for an
+answer.
+*/
+func statusHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	body, err := ctx.statusBody()
+	if err != nil {
+		log.Printf("Error encoding status: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		log.Printf("statusHandler unable to write, with this error: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Tiers let operators run trusted proxies in a priority pool that is offered
+first to clients asking for priority. A proxy polls with a tier by presenting
+a bearer token that the tiers file allows for that tier.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Reads a file of "tier token" lines, ignoring blank lines and those starting
+// with '#', and returns the map from tokens to tiers.
+func loadProxyTiers(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tiers := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line %d: expected \"tier token\"", filename, lineno)
+		}
+		tiers[fields[1]] = fields[0]
+	}
+	return tiers, scanner.Err()
+}
+
+// Reports whether the request carries a bearer token allowed to poll with the
+// tier.
+func (ctx *BrokerContext) authorizedTier(r *http.Request, tier string) bool {
+	got := []byte(r.Header.Get("Authorization"))
+	authorized := false
+	ctx.reloadLock.RLock()
+	defer ctx.reloadLock.RUnlock()
+	// Compare against every token so as not to leak which one is closest.
+	for token, tokenTier := range ctx.proxyTiers {
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) == 1 && tokenTier == tier {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// Returns the priority heap holding the tiered counterparts of the
+// snowflakes in the given general heap.
+func (ctx *BrokerContext) priorityHeap(snowflakeHeap *SnowflakeHeap) *SnowflakeHeap {
+	if snowflakeHeap == ctx.restrictedSnowflakes {
+		return ctx.priorityRestrictedSnowflakes
+	}
+	return ctx.prioritySnowflakes
+}
@@ -0,0 +1,172 @@
+/*
+Operator control over the TLS configuration of the broker's listener.
+*/
+
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersionsByName = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Cipher suites that may be selected for TLS 1.2 and earlier. TLS 1.3 cipher
+// suites are not configurable.
+var cipherSuitesByName = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// Builds a TLS configuration with the given minimum version ("1.0" through
+// "1.3") and comma-separated list of allowed cipher suite names. Empty values
+// leave the Go defaults in place.
+func newTLSConfig(minVersion string, cipherSuites string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if minVersion != "" {
+		version, ok := tlsVersionsByName[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if cipherSuites != "" {
+		for _, name := range strings.Split(cipherSuites, ",") {
+			suite, ok := cipherSuitesByName[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, suite)
+		}
+	}
+
+	return config, nil
+}
+
+// Gets the certificate of each of hostnames in turn, as a handshake naming it
+// would, so that an ACME certificate manager fetches and caches them before
+// the first clients arrive. Failures are logged, leaving the certificate to
+// be fetched on demand.
+func warmCertificates(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), hostnames []string) {
+	for _, hostname := range hostnames {
+		if _, err := getCertificate(&tls.ClientHelloInfo{ServerName: hostname}); err != nil {
+			log.Printf("Warning: couldn't get a certificate for %q in advance: %v", hostname, err)
+		}
+	}
+}
+
+// How often at most the certificate files are checked for changes.
+const certCheckInterval = 5 * time.Second
+
+// Serves the certificate and key in a pair of files, loading them again when
+// either file's modification time changes, so that certificates can be
+// rotated without a restart.
+type certReloader struct {
+	certFilename string
+	keyFilename  string
+
+	lock sync.Mutex
+	cert *tls.Certificate
+	// Modification times of the files the certificate was last loaded, or
+	// tried to be loaded, from.
+	certModTime time.Time
+	keyModTime  time.Time
+	// When to next check the files for changes.
+	nextCheck time.Time
+	// The error of the last check, so that a lasting one is logged once.
+	lastError string
+	// Returns the current time, replaceable in tests.
+	now func() time.Time
+}
+
+func (r *certReloader) currentTime() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// Returns a reloader serving the certificate in certFilename and keyFilename,
+// which must load now.
+func newCertReloader(certFilename, keyFilename string) (*certReloader, error) {
+	r := &certReloader{certFilename: certFilename, keyFilename: keyFilename}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.nextCheck = r.currentTime().Add(certCheckInterval)
+	return r, nil
+}
+
+// Loads the certificate if either file has changed since it was last loaded
+// or tried to be. Returns whether it tried. The modification times are
+// remembered even if the files fail to load, so that they are not tried again
+// until they change once more. The caller must hold r.lock.
+func (r *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(r.certFilename)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(r.keyFilename)
+	if err != nil {
+		return false, err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return false, nil
+	}
+	r.certModTime, r.keyModTime = certInfo.ModTime(), keyInfo.ModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFilename, r.keyFilename)
+	if err != nil {
+		return true, err
+	}
+	if r.cert != nil {
+		log.Printf("Reloaded TLS certificate %q", r.certFilename)
+	}
+	r.cert = &cert
+	return true, nil
+}
+
+// For tls.Config.GetCertificate. The files are checked for changes at most
+// every certCheckInterval. If they have changed but can't be loaded, for
+// instance while only one of them has been replaced, the previous certificate
+// is served, and a warning logged once for the change.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.currentTime()
+	if now.Before(r.nextCheck) {
+		return r.cert, nil
+	}
+	r.nextCheck = now.Add(certCheckInterval)
+	tried, err := r.reload()
+	if err == nil {
+		r.lastError = ""
+	} else if tried || err.Error() != r.lastError {
+		log.Printf("Warning: couldn't reload TLS certificate, serving the previous one: %v", err)
+		r.lastError = err.Error()
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,53 @@
+/*
+Identification of the running build, so that behavior can be correlated with
+the code deployed. The version and commit are set at link time, for instance
+with
+
+	go build -ldflags "-X github.com/RACECAR-GU/snowflake/broker.version=v2.0.0 -X github.com/RACECAR-GU/snowflake/broker.commit=$(git rev-parse HEAD)"
+
+and are "unknown" otherwise.
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+)
+
+// Set with -ldflags -X.
+var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
+type versionResponse struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Go      string `json:"go"`
+}
+
+func buildVersion() versionResponse {
+	return versionResponse{
+		Version: version,
+		Commit:  commit,
+		Go:      runtime.Version(),
+	}
+}
+
+// Reports the version and commit the broker was built from, and the Go
+// release it was built with.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(buildVersion())
+	if err != nil {
+		log.Printf("Error encoding version: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		log.Printf("versionHandler unable to write, with this error: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Virtual hosts with separate pools of snowflakes, so that one broker process can
+serve several projects without handing the proxies of one to the clients of
+another. Requests are routed to a pool by their Host header.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Parses comma-separated host=pool pairs, such as
+// "a.example=alpha,b.example=beta", into a map from hostnames to the names of
+// their pools. Hosts given the same pool name share the pool.
+func parseVhostPools(s string) (map[string]string, error) {
+	pools := make(map[string]string)
+	if s == "" {
+		return pools, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid virtual host pool %q", pair)
+		}
+		host := strings.ToLower(fields[0])
+		if _, ok := pools[host]; ok {
+			return nil, fmt.Errorf("virtual host %q is given more than one pool", host)
+		}
+		pools[host] = fields[1]
+	}
+	return pools, nil
+}
+
+// Returns the names of the pools in vhostPools, sorted.
+func vhostPoolNames(vhostPools map[string]string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range vhostPools {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns a context with ctx's configuration and metrics, but with pools of
+// snowflakes and queues of clients of its own. It follows ctx's draining and
+// reloads.
+func (ctx *BrokerContext) newPool() *BrokerContext {
+	pool := newBrokerContext(ctx.metrics)
+	pool.maxTrackedProxies = ctx.maxTrackedProxies
+	pool.proxyPollSendTimeout = ctx.proxyPollSendTimeout
+	// The limits on goroutines and offers in flight are for the whole
+	// broker, so the pools share them.
+	pool.matchWorkers = ctx.matchWorkers
+	pool.inflightClients = ctx.inflightClients
+	pool.clientIDs = ctx.clientIDs
+	pool.shedLatency = ctx.shedLatency
+	pool.minProxiesBeforeServing = ctx.minProxiesBeforeServing
+	pool.clientQueueWait = ctx.clientQueueWait
+	pool.maxOfferAge = ctx.maxOfferAge
+	pool.proxyLifetimes.maxLifetime = ctx.proxyLifetimes.maxLifetime
+	pool.proxyLifetimes.cooldown = ctx.proxyLifetimes.cooldown
+	pool.proxyQuarantine.threshold = ctx.proxyQuarantine.threshold
+	pool.proxyQuarantine.window = ctx.proxyQuarantine.window
+	pool.proxyQuarantine.cooldown = ctx.proxyQuarantine.cooldown
+	pool.proxyHeartbeats.staleAfter = ctx.proxyHeartbeats.staleAfter
+	pool.config = ctx.config
+	pool.clientTimeout = ctx.clientTimeout
+	pool.proxyTimeout = ctx.proxyTimeout
+	pool.maxClientTimeout = ctx.maxClientTimeout
+	pool.maxProxyTimeout = ctx.maxProxyTimeout
+	pool.matchDeadline = ctx.matchDeadline
+	pool.minAdaptiveProxyTimeout = ctx.minAdaptiveProxyTimeout
+	pool.maxAdaptiveProxyTimeout = ctx.maxAdaptiveProxyTimeout
+	pool.clientTimeoutByNAT = ctx.clientTimeoutByNAT
+	pool.answerRetries = ctx.answerRetries
+	pool.answerDeliverTimeout = ctx.answerDeliverTimeout
+	pool.channelBuffer = ctx.channelBuffer
+	pool.natRedetection.threshold = ctx.natRedetection.threshold
+	pool.timeoutJitter = ctx.timeoutJitter
+	pool.corsOrigin = ctx.corsOrigin
+	pool.corsMaxAge = ctx.corsMaxAge
+	pool.corsAllowedOrigins = ctx.corsAllowedOrigins
+	pool.eventLog = ctx.eventLog
+	pool.metricsAuth = ctx.metricsAuth
+	pool.shadow = ctx.shadow
+	pool.requireSDPFingerprint = ctx.requireSDPFingerprint
+	pool.fallbackBrokerURL = ctx.fallbackBrokerURL
+	pool.decoyPage = ctx.decoyPage
+	pool.matchStrategy = ctx.matchStrategy
+	pool.matchLog = ctx.matchLog
+	pool.qualityMatching = ctx.qualityMatching
+	pool.regionMatching = ctx.regionMatching
+	pool.allowRestrictedFallback = ctx.allowRestrictedFallback
+	pool.allowedRegions = ctx.allowedRegions
+	pool.iceServers = ctx.iceServers
+	pool.clientFanout = ctx.clientFanout
+	pool.proxyTypeWeights = ctx.proxyTypeWeights
+	ctx.copyReloadable(pool)
+	pool.SetDraining(ctx.Draining())
+	ctx.vhostPools = append(ctx.vhostPools, pool)
+	return pool
+}
+
+// Copies the configuration replaced on reload from ctx to pool.
+func (ctx *BrokerContext) copyReloadable(pool *BrokerContext) {
+	ctx.reloadLock.RLock()
+	adminToken, proxyTiers, allowedProxyTypes := ctx.adminToken, ctx.proxyTiers, ctx.allowedProxyTypes
+	ctx.reloadLock.RUnlock()
+	pool.reloadLock.Lock()
+	pool.adminToken, pool.proxyTiers, pool.allowedProxyTypes = adminToken, proxyTiers, allowedProxyTypes
+	pool.reloadLock.Unlock()
+}
+
+// Implements the http.Handler interface, passing requests on to the handler
+// for their Host, without any port, and answering 404 to those for other
+// hosts.
+type VhostHandler struct {
+	hosts map[string]http.Handler
+}
+
+func (vh VhostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	handler, ok := vh.hosts[strings.ToLower(host)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// Returns a handler serving the endpoints of a separate pool for each pool
+// named in vhostPools, to the hosts given that pool. The first pool by name
+// is ctx's own, and the Broker of each other pool is started.
+func newVhostHandler(ctx *BrokerContext, cfg Config, vhostPools map[string]string) VhostHandler {
+	muxes := make(map[string]http.Handler)
+	for i, name := range vhostPoolNames(vhostPools) {
+		pool := ctx
+		if i > 0 {
+			pool = ctx.newPool()
+			go pool.Broker()
+		}
+		muxes[name] = newServeMux(pool, cfg)
+	}
+	hosts := make(map[string]http.Handler)
+	for host, name := range vhostPools {
+		hosts[host] = muxes[name]
+	}
+	return VhostHandler{hosts}
+}
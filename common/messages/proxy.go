@@ -18,7 +18,12 @@ const version = "1.2"
   Sid: [generated session id of proxy],
   Version: 1.2,
   Type: ["badge"|"webext"|"standalone"]
-  NAT: ["unknown"|"restricted"|"unrestricted"]
+  NAT: ["unknown"|"restricted"|"unrestricted", others taken as "unknown"]
+  Batch: [optional maximum number of offers to return, default 1]
+  Tier: [optional priority pool of a trusted proxy, requiring a token]
+  Load: [optional fraction in [0, 1] of the proxy's bandwidth in use, default 0]
+  Wait: [optional seconds the proxy will wait for an offer, default the broker's proxy timeout]
+  Region: [optional region or datacenter label of the proxy, among those the broker allows]
 }
 
 == ProxyPollResponse ==
@@ -31,16 +36,43 @@ HTTP 200 OK
     sdp: [WebRTC SDP]
   },
   NAT: ["unknown"|"restricted"|"unrestricted"]
+  Encoding: [optional tag of the envelope the client wrapped its offer in]
+  RedetectNAT: [optional, true if the proxy should detect its NAT type again]
+  ICEServers: [optional list of STUN or TURN server URLs for the proxy to use]
+}
+
+2) If clients are matched with a poll whose Batch is greater than 1:
+HTTP 200 OK
+{
+  Status: "client match",
+  Offers: [
+    {
+      Sid: [sub-id to answer this offer with],
+      Offer:
+      {
+        type: offer,
+        sdp: [WebRTC SDP]
+      },
+      NAT: ["unknown"|"restricted"|"unrestricted"],
+      Encoding: [optional tag of the envelope the client wrapped its offer in]
+    },
+    ...
+  ]
+  ICEServers: [optional list of STUN or TURN server URLs for the proxy to use]
 }
 
-2) If a client is not matched:
+3) If a client is not matched:
 HTTP 200 OK
 
 {
     Status: "no match"
+    RedetectNAT: [optional, true if the proxy should detect its NAT type again]
 }
 
-3) If the request is malformed:
+A proxy asked to redetect its NAT type sends the type it finds in its next
+poll, which replaces the one it registered with.
+
+4) If the request is malformed:
 HTTP 400 BadRequest
 
 == ProxyAnswerRequest ==
@@ -51,9 +83,13 @@ HTTP 400 BadRequest
   {
     type: answer,
     sdp: [WebRTC SDP]
-  }
+  },
+  Encoding: [optional tag of the envelope the proxy wrapped its answer in]
 }
 
+An offer or answer with an Encoding tag is opaque to the broker, which passes
+it and its tag on unchanged for the peers to unwrap.
+
 == ProxyAnswerResponse ==
 1) If the client retrieved the answer:
 HTTP 200 OK
@@ -72,13 +108,93 @@ HTTP 200 OK
 3) If the request is malformed:
 HTTP 400 BadRequest
 
+== ProxyDeregisterRequest ==
+{
+  Sid: [generated session id of proxy],
+  Version: 1.2
+}
+
+== ProxyDeregisterResponse ==
+1) If the proxy was waiting for a client:
+HTTP 200 OK
+
+2) If the proxy is not recognized:
+HTTP 404 NotFound
+
+3) If the request is malformed:
+HTTP 400 BadRequest
+
+== ProxyAckRequest ==
+{
+  Sid: [generated session id of proxy],
+  Version: 1.2,
+  Status: ["success"|"failure"]
+}
+
+Sent by a proxy once its connection with the client it answered has succeeded
+or failed.
+
+== ProxyAckResponse ==
+1) If the broker delivered the proxy's answer recently:
+HTTP 200 OK
+
+2) If the proxy is not recognized:
+HTTP 404 NotFound
+
+3) If the request is malformed:
+HTTP 400 BadRequest
+
 */
 
+// Fields of a ProxyPollRequest that may fail to decode, as named by
+// PollDecodeError
+const (
+	// The message is not a JSON object at all
+	PollFieldBody    = "body"
+	PollFieldSid     = "sid"
+	PollFieldVersion = "version"
+	PollFieldType    = "type"
+	PollFieldNAT     = "nat"
+	PollFieldBatch   = "batch"
+	PollFieldTier    = "tier"
+	PollFieldLoad    = "load"
+	PollFieldWait    = "wait"
+	PollFieldRegion  = "region"
+)
+
+// The error returned when a poll message fails to decode, naming the field at
+// fault with one of the PollField constants
+type PollDecodeError struct {
+	Field string
+	Err   error
+}
+
+func (e *PollDecodeError) Error() string {
+	return fmt.Sprintf("poll %s: %v", e.Field, e.Err)
+}
+
+func (e *PollDecodeError) Unwrap() error {
+	return e.Err
+}
+
 type ProxyPollRequest struct {
 	Sid     string
 	Version string
 	Type    string
 	NAT     string
+	Batch   int    `json:",omitempty"`
+	Tier    string `json:",omitempty"`
+	// Hint of how busy the proxy is, so that busier proxies are matched later
+	Load float64 `json:",omitempty"`
+	// Longest the proxy will wait for an offer, in seconds, which the broker
+	// clamps to its own bounds
+	Wait float64 `json:",omitempty"`
+	// Region or datacenter the proxy declares itself in, which the broker
+	// ignores unless it is among those allowed
+	Region string `json:",omitempty"`
+	// Set on decoding if the NAT type sent was not one known, in which case
+	// NAT is taken as "unknown"
+	UnknownNAT bool `json:"-"`
 }
 
 func EncodePollRequest(sid string, proxyType string, natType string) ([]byte, error) {
@@ -90,116 +206,294 @@ func EncodePollRequest(sid string, proxyType string, natType string) ([]byte, er
 	})
 }
 
+func EncodeRegionPollRequest(sid string, proxyType string, natType string, region string) ([]byte, error) {
+	return json.Marshal(ProxyPollRequest{
+		Sid:     sid,
+		Version: version,
+		Type:    proxyType,
+		NAT:     natType,
+		Region:  region,
+	})
+}
+
+func EncodeBatchPollRequest(sid string, proxyType string, natType string, batch int) ([]byte, error) {
+	return json.Marshal(ProxyPollRequest{
+		Sid:     sid,
+		Version: version,
+		Type:    proxyType,
+		NAT:     natType,
+		Batch:   batch,
+	})
+}
+
 // Decodes a poll message from a snowflake proxy and returns the
 // sid and proxy type of the proxy on success and an error if it failed
 func DecodePollRequest(data []byte) (string, string, string, error) {
+	sid, proxyType, natType, _, err := DecodeBatchPollRequest(data)
+	return sid, proxyType, natType, err
+}
+
+// Like DecodePollRequest, but also returns the number of offers the proxy
+// asked for, which is at least 1
+func DecodeBatchPollRequest(data []byte) (string, string, string, int, error) {
+	message, err := DecodePollRequestMessage(data)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	return message.Sid, message.Type, message.NAT, message.Batch, nil
+}
+
+// Decodes and validates a poll message from a snowflake proxy, filling in the
+// defaults of the optional fields. Errors are of type *PollDecodeError
+func DecodePollRequestMessage(data []byte) (*ProxyPollRequest, error) {
 	var message ProxyPollRequest
 
 	err := json.Unmarshal(data, &message)
-	if err != nil {
-		return "", "", "", err
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return nil, &PollDecodeError{Field: strings.ToLower(typeErr.Field), Err: err}
+	} else if err != nil {
+		return nil, &PollDecodeError{Field: PollFieldBody, Err: err}
 	}
 
 	majorVersion := strings.Split(message.Version, ".")[0]
 	if majorVersion != "1" {
-		return "", "", "", fmt.Errorf("using unknown version")
+		return nil, &PollDecodeError{Field: PollFieldVersion, Err: fmt.Errorf("using unknown version")}
 	}
 
 	// Version 1.x requires an Sid
 	if message.Sid == "" {
-		return "", "", "", fmt.Errorf("no supplied session id")
+		return nil, &PollDecodeError{Field: PollFieldSid, Err: fmt.Errorf("no supplied session id")}
+	}
+
+	switch message.NAT {
+	case "":
+		message.NAT = "unknown"
+	case "unknown", "restricted", "unrestricted":
+	default:
+		// Proxies sending NAT types of newer or other kinds are matched as
+		// if theirs were unknown, rather than refused.
+		message.NAT = "unknown"
+		message.UnknownNAT = true
+	}
+
+	if message.Batch < 1 {
+		message.Batch = 1
 	}
 
-	natType := message.NAT
-	if natType == "" {
-		natType = "unknown"
+	if message.Load < 0 || message.Load > 1 {
+		return nil, &PollDecodeError{Field: PollFieldLoad, Err: fmt.Errorf("load %v is not in [0, 1]", message.Load)}
 	}
 
-	return message.Sid, message.Type, natType, nil
+	if message.Wait < 0 {
+		return nil, &PollDecodeError{Field: PollFieldWait, Err: fmt.Errorf("wait %v is negative", message.Wait)}
+	}
+
+	return &message, nil
 }
 
 type ProxyPollResponse struct {
 	Status string
 	Offer  string
 	NAT    string
+	Offers []ProxyPollOffer `json:",omitempty"`
+	// Tag of the envelope the offer is wrapped in, if any
+	Encoding string `json:",omitempty"`
+	// Set when the broker suspects the proxy's NAT type is stale
+	RedetectNAT bool `json:",omitempty"`
+	// URLs of STUN or TURN servers the broker suggests, passed on as they
+	// are
+	ICEServers []string `json:",omitempty"`
+}
+
+// One of the offers in the response to a batched poll
+type ProxyPollOffer struct {
+	Sid      string
+	Offer    string
+	NAT      string
+	Encoding string `json:",omitempty"`
 }
 
 func EncodePollResponse(offer string, success bool, natType string) ([]byte, error) {
+	return EncodeRedetectPollResponse(offer, success, natType, false)
+}
+
+// Like EncodePollResponse, but also asks the proxy to detect its NAT type
+// again if redetectNAT is true
+func EncodeRedetectPollResponse(offer string, success bool, natType string, redetectNAT bool) ([]byte, error) {
 	if success {
 		return json.Marshal(ProxyPollResponse{
-			Status: "client match",
-			Offer:  offer,
-			NAT:    natType,
+			Status:      "client match",
+			Offer:       offer,
+			NAT:         natType,
+			RedetectNAT: redetectNAT,
 		})
 
 	}
 	return json.Marshal(ProxyPollResponse{
-		Status: "no match",
+		Status:      "no match",
+		RedetectNAT: redetectNAT,
+	})
+}
+
+// Encodes the response to a proxy matched with a client whose offer is wrapped
+// in the envelope tagged encoding, or is bare SDP if encoding is empty
+func EncodeTaggedPollResponse(offer string, natType string, encoding string, redetectNAT bool) ([]byte, error) {
+	return EncodeICEPollResponse(offer, natType, encoding, redetectNAT, nil)
+}
+
+// Like EncodeTaggedPollResponse, but also suggests the ICE servers given to
+// the proxy
+func EncodeICEPollResponse(offer string, natType string, encoding string, redetectNAT bool, iceServers []string) ([]byte, error) {
+	return json.Marshal(ProxyPollResponse{
+		Status:      "client match",
+		Offer:       offer,
+		NAT:         natType,
+		Encoding:    encoding,
+		RedetectNAT: redetectNAT,
+		ICEServers:  iceServers,
 	})
 }
 
 // Decodes a poll response from the broker and returns an offer and the client's NAT type
 // If there is a client match, the returned offer string will be non-empty
 func DecodePollResponse(data []byte) (string, string, error) {
+	message, err := DecodePollResponseMessage(data)
+	if err != nil {
+		return "", "", err
+	}
+	return message.Offer, message.NAT, nil
+}
+
+// Decodes and validates a poll response from the broker, filling in the
+// defaults of the optional fields. The Offer is empty if there is no client
+// match
+func DecodePollResponseMessage(data []byte) (*ProxyPollResponse, error) {
 	var message ProxyPollResponse
 
 	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 	if message.Status == "" {
-		return "", "", fmt.Errorf("received invalid data")
+		return nil, fmt.Errorf("received invalid data")
 	}
 
 	if message.Status == "client match" {
 		if message.Offer == "" {
-			return "", "", fmt.Errorf("no supplied offer")
+			return nil, fmt.Errorf("no supplied offer")
 		}
 	} else {
 		message.Offer = ""
 	}
 
-	natType := message.NAT
-	if natType == "" {
-		natType = "unknown"
+	if message.NAT == "" {
+		message.NAT = "unknown"
 	}
 
-	return message.Offer, natType, nil
+	return &message, nil
+}
+
+func EncodeBatchPollResponse(offers []ProxyPollOffer) ([]byte, error) {
+	return EncodeICEBatchPollResponse(offers, nil)
+}
+
+// Like EncodeBatchPollResponse, but also suggests the ICE servers given to
+// the proxy if there are offers
+func EncodeICEBatchPollResponse(offers []ProxyPollOffer, iceServers []string) ([]byte, error) {
+	if len(offers) > 0 {
+		return json.Marshal(ProxyPollResponse{
+			Status:     "client match",
+			Offers:     offers,
+			ICEServers: iceServers,
+		})
+	}
+	return json.Marshal(ProxyPollResponse{
+		Status: "no match",
+	})
+}
+
+// Decodes the response to a batched poll and returns the matched offers,
+// which are empty if there was no client match
+func DecodeBatchPollResponse(data []byte) ([]ProxyPollOffer, error) {
+	var message ProxyPollResponse
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	if message.Status == "" {
+		return nil, fmt.Errorf("received invalid data")
+	}
+
+	if message.Status != "client match" {
+		return nil, nil
+	}
+	if len(message.Offers) == 0 {
+		return nil, fmt.Errorf("no supplied offers")
+	}
+	for i := range message.Offers {
+		if message.Offers[i].Sid == "" || message.Offers[i].Offer == "" {
+			return nil, fmt.Errorf("no supplied sid or offer")
+		}
+		if message.Offers[i].NAT == "" {
+			message.Offers[i].NAT = "unknown"
+		}
+	}
+
+	return message.Offers, nil
 }
 
 type ProxyAnswerRequest struct {
 	Version string
 	Sid     string
 	Answer  string
+	// Tag of the envelope the answer is wrapped in, if any
+	Encoding string `json:",omitempty"`
 }
 
 func EncodeAnswerRequest(answer string, sid string) ([]byte, error) {
+	return EncodeTaggedAnswerRequest(answer, sid, "")
+}
+
+// Like EncodeAnswerRequest, but for an answer wrapped in the envelope tagged
+// encoding
+func EncodeTaggedAnswerRequest(answer string, sid string, encoding string) ([]byte, error) {
 	return json.Marshal(ProxyAnswerRequest{
-		Version: version,
-		Sid:     sid,
-		Answer:  answer,
+		Version:  version,
+		Sid:      sid,
+		Answer:   answer,
+		Encoding: encoding,
 	})
 }
 
 // Returns the sdp answer and proxy sid
 func DecodeAnswerRequest(data []byte) (string, string, error) {
+	message, err := DecodeAnswerRequestMessage(data)
+	if err != nil {
+		return "", "", err
+	}
+	return message.Answer, message.Sid, nil
+}
+
+// Decodes and validates an answer message from a snowflake proxy
+func DecodeAnswerRequestMessage(data []byte) (*ProxyAnswerRequest, error) {
 	var message ProxyAnswerRequest
 
 	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	majorVersion := strings.Split(message.Version, ".")[0]
 	if majorVersion != "1" {
-		return "", "", fmt.Errorf("using unknown version")
+		return nil, fmt.Errorf("using unknown version")
 	}
 
 	if message.Sid == "" || message.Answer == "" {
-		return "", "", fmt.Errorf("no supplied sid or answer")
+		return nil, fmt.Errorf("no supplied sid or answer")
 	}
 
-	return message.Answer, message.Sid, nil
+	return &message, nil
 }
 
 type ProxyAnswerResponse struct {
@@ -236,3 +530,86 @@ func DecodeAnswerResponse(data []byte) (bool, error) {
 
 	return success, nil
 }
+
+type ProxyDeregisterRequest struct {
+	Sid     string
+	Version string
+}
+
+func EncodeDeregisterRequest(sid string) ([]byte, error) {
+	return json.Marshal(ProxyDeregisterRequest{
+		Sid:     sid,
+		Version: version,
+	})
+}
+
+// Decodes a deregistration message from a snowflake proxy and returns the
+// sid of the proxy on success and an error if it failed
+func DecodeDeregisterRequest(data []byte) (string, error) {
+	var message ProxyDeregisterRequest
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return "", err
+	}
+
+	majorVersion := strings.Split(message.Version, ".")[0]
+	if majorVersion != "1" {
+		return "", fmt.Errorf("using unknown version")
+	}
+
+	if message.Sid == "" {
+		return "", fmt.Errorf("no supplied session id")
+	}
+
+	return message.Sid, nil
+}
+
+// Outcomes of a proxy's connection with its client, as acknowledged
+const (
+	AckSuccess = "success"
+	AckFailure = "failure"
+)
+
+type ProxyAckRequest struct {
+	Sid     string
+	Version string
+	Status  string
+}
+
+func EncodeAckRequest(sid string, status string) ([]byte, error) {
+	return json.Marshal(ProxyAckRequest{
+		Sid:     sid,
+		Version: version,
+		Status:  status,
+	})
+}
+
+// Decodes an acknowledgement from a snowflake proxy and returns the sid of
+// the proxy and the outcome of its connection on success and an error if it
+// failed
+func DecodeAckRequest(data []byte) (string, string, error) {
+	var message ProxyAckRequest
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return "", "", err
+	}
+
+	majorVersion := strings.Split(message.Version, ".")[0]
+	if majorVersion != "1" {
+		return "", "", fmt.Errorf("using unknown version")
+	}
+
+	if message.Sid == "" {
+		return "", "", fmt.Errorf("no supplied session id")
+	}
+
+	switch message.Status {
+	case AckSuccess, AckFailure:
+	default:
+		return "", "", fmt.Errorf("unknown status %q", message.Status)
+	}
+
+	return message.Sid, message.Status, nil
+}
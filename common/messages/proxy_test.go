@@ -41,41 +41,49 @@ func TestDecodeProxyPollRequest(t *testing.T) {
 				`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Type":"standalone", "NAT":"restricted"}`,
 				nil,
 			},
+			{
+				//Version 1.2 proxy message with a NAT type not known
+				"ymbcCMto7KHNGYlp",
+				"standalone",
+				"unknown",
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Type":"standalone", "NAT":"symmetric"}`,
+				nil,
+			},
 			{
 				//Version 0.X proxy message:
 				"",
 				"",
 				"",
 				"",
-				&json.SyntaxError{},
+				&PollDecodeError{},
 			},
 			{
 				"",
 				"",
 				"",
 				`{"Sid":"ymbcCMto7KHNGYlp"}`,
-				fmt.Errorf(""),
+				&PollDecodeError{},
 			},
 			{
 				"",
 				"",
 				"",
 				"{}",
-				fmt.Errorf(""),
+				&PollDecodeError{},
 			},
 			{
 				"",
 				"",
 				"",
 				`{"Version":"1.0"}`,
-				fmt.Errorf(""),
+				&PollDecodeError{},
 			},
 			{
 				"",
 				"",
 				"",
 				`{"Version":"2.0"}`,
-				fmt.Errorf(""),
+				&PollDecodeError{},
 			},
 		} {
 			sid, proxyType, natType, err := DecodePollRequest([]byte(test.data))
@@ -85,6 +93,43 @@ func TestDecodeProxyPollRequest(t *testing.T) {
 			So(err, ShouldHaveSameTypeAs, test.err)
 		}
 
+		message, err := DecodePollRequestMessage([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","NAT":"symmetric"}`))
+		So(err, ShouldBeNil)
+		So(message.UnknownNAT, ShouldBeTrue)
+		message, err = DecodePollRequestMessage([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","NAT":"restricted"}`))
+		So(err, ShouldBeNil)
+		So(message.UnknownNAT, ShouldBeFalse)
+	})
+}
+
+func TestDecodeProxyPollRequestFields(t *testing.T) {
+	Convey("Context", t, func() {
+		for _, test := range []struct {
+			field string
+			data  string
+		}{
+			{PollFieldBody, ""},
+			{PollFieldBody, `["ymbcCMto7KHNGYlp"]`},
+			{PollFieldVersion, `{"Sid":"ymbcCMto7KHNGYlp"}`},
+			{PollFieldVersion, `{"Sid":"ymbcCMto7KHNGYlp","Version":"2.0"}`},
+			{PollFieldVersion, `{"Sid":"ymbcCMto7KHNGYlp","Version":1.2}`},
+			{PollFieldSid, `{"Version":"1.2"}`},
+			{PollFieldSid, `{"Sid":42,"Version":"1.2"}`},
+			{PollFieldType, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Type":["standalone"]}`},
+			{PollFieldNAT, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","NAT":true}`},
+			{PollFieldBatch, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Batch":"4"}`},
+			{PollFieldTier, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Tier":1}`},
+			{PollFieldLoad, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Load":1.5}`},
+			{PollFieldLoad, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Load":-0.1}`},
+			{PollFieldLoad, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Load":"high"}`},
+			{PollFieldWait, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Wait":-1}`},
+			{PollFieldWait, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Wait":"2s"}`},
+			{PollFieldRegion, `{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Region":["eu-west"]}`},
+		} {
+			_, err := DecodePollRequestMessage([]byte(test.data))
+			So(err, ShouldHaveSameTypeAs, &PollDecodeError{})
+			So(err.(*PollDecodeError).Field, ShouldEqual, test.field)
+		}
 	})
 }
 
@@ -153,6 +198,149 @@ func TestEncodeProxyPollResponse(t *testing.T) {
 		So(err, ShouldEqual, nil)
 	})
 }
+
+func TestEncodeRedetectPollResponse(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeRedetectPollResponse("fake offer", true, "restricted", true)
+		So(err, ShouldEqual, nil)
+		message, err := DecodePollResponseMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Offer, ShouldEqual, "fake offer")
+		So(message.NAT, ShouldEqual, "restricted")
+		So(message.RedetectNAT, ShouldBeTrue)
+
+		b, err = EncodeRedetectPollResponse("", false, "", true)
+		So(err, ShouldEqual, nil)
+		message, err = DecodePollResponseMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Offer, ShouldEqual, "")
+		So(message.RedetectNAT, ShouldBeTrue)
+
+		b, err = EncodePollResponse("", false, "")
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldNotContainSubstring, "RedetectNAT")
+		message, err = DecodePollResponseMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.RedetectNAT, ShouldBeFalse)
+	})
+}
+
+func TestEncodeTaggedPollResponse(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeTaggedPollResponse("opaque offer", "restricted", "v1;scheme=test", false)
+		So(err, ShouldEqual, nil)
+		message, err := DecodePollResponseMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Offer, ShouldEqual, "opaque offer")
+		So(message.NAT, ShouldEqual, "restricted")
+		So(message.Encoding, ShouldEqual, "v1;scheme=test")
+		So(message.RedetectNAT, ShouldBeFalse)
+
+		b, err = EncodeTaggedPollResponse("fake offer", "restricted", "", false)
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldNotContainSubstring, "Encoding")
+		So(string(b), ShouldNotContainSubstring, "ICEServers")
+	})
+}
+
+func TestEncodeICEPollResponse(t *testing.T) {
+	Convey("Context", t, func() {
+		iceServers := []string{"stun:stun.example:3478", "turn:turn.example:3478?transport=tcp"}
+		b, err := EncodeICEPollResponse("fake offer", "restricted", "", false, iceServers)
+		So(err, ShouldEqual, nil)
+		message, err := DecodePollResponseMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Offer, ShouldEqual, "fake offer")
+		So(message.ICEServers, ShouldResemble, iceServers)
+
+		offers := []ProxyPollOffer{{Sid: "ymbcCMto7KHNGYlp-0", Offer: "fake offer 0", NAT: "restricted"}}
+		b, err = EncodeICEBatchPollResponse(offers, iceServers)
+		So(err, ShouldEqual, nil)
+		var batch ProxyPollResponse
+		So(json.Unmarshal(b, &batch), ShouldBeNil)
+		So(batch.Offers, ShouldHaveLength, 1)
+		So(batch.ICEServers, ShouldResemble, iceServers)
+	})
+}
+
+func TestEncodeProxyRegionPollRequests(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeRegionPollRequest("ymbcCMto7KHNGYlp", "standalone", "unknown", "eu-west")
+		So(err, ShouldEqual, nil)
+		message, err := DecodePollRequestMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(message.Region, ShouldEqual, "eu-west")
+
+		b, err = EncodePollRequest("ymbcCMto7KHNGYlp", "standalone", "unknown")
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldNotContainSubstring, "Region")
+	})
+}
+
+func TestEncodeProxyBatchPollRequests(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeBatchPollRequest("ymbcCMto7KHNGYlp", "standalone", "unknown", 4)
+		So(err, ShouldEqual, nil)
+		sid, proxyType, natType, batch, err := DecodeBatchPollRequest(b)
+		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(proxyType, ShouldEqual, "standalone")
+		So(natType, ShouldEqual, "unknown")
+		So(batch, ShouldEqual, 4)
+		So(err, ShouldEqual, nil)
+
+		b, err = EncodePollRequest("ymbcCMto7KHNGYlp", "standalone", "unknown")
+		So(err, ShouldEqual, nil)
+		_, _, _, batch, err = DecodeBatchPollRequest(b)
+		So(batch, ShouldEqual, 1)
+		So(err, ShouldEqual, nil)
+	})
+}
+
+func TestDecodeProxyPollRequestMessage(t *testing.T) {
+	Convey("Context", t, func() {
+		message, err := DecodePollRequestMessage([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Type":"standalone","Tier":"fast"}`))
+		So(err, ShouldEqual, nil)
+		So(message.Sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(message.NAT, ShouldEqual, "unknown")
+		So(message.Batch, ShouldEqual, 1)
+		So(message.Tier, ShouldEqual, "fast")
+		So(message.Load, ShouldEqual, 0)
+		So(message.Wait, ShouldEqual, 0)
+
+		message, err = DecodePollRequestMessage([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Type":"standalone","Load":0.75,"Wait":2.5}`))
+		So(err, ShouldEqual, nil)
+		So(message.Load, ShouldEqual, 0.75)
+		So(message.Wait, ShouldEqual, 2.5)
+
+		_, err = DecodePollRequestMessage([]byte(`{"Version":"1.2","Tier":"fast"}`))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEncodeProxyBatchPollResponse(t *testing.T) {
+	Convey("Context", t, func() {
+		offers := []ProxyPollOffer{
+			{Sid: "ymbcCMto7KHNGYlp-0", Offer: "fake offer 0", NAT: "restricted"},
+			{Sid: "ymbcCMto7KHNGYlp-1", Offer: "fake offer 1", NAT: "unrestricted"},
+		}
+		b, err := EncodeBatchPollResponse(offers)
+		So(err, ShouldEqual, nil)
+		decoded, err := DecodeBatchPollResponse(b)
+		So(decoded, ShouldResemble, offers)
+		So(err, ShouldEqual, nil)
+
+		b, err = EncodeBatchPollResponse(nil)
+		So(err, ShouldEqual, nil)
+		decoded, err = DecodeBatchPollResponse(b)
+		So(decoded, ShouldBeEmpty)
+		So(err, ShouldEqual, nil)
+
+		_, err = DecodeBatchPollResponse([]byte(`{"Status":"client match","Offers":[{"Sid":"test"}]}`))
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestDecodeProxyAnswerRequest(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
@@ -206,6 +394,25 @@ func TestEncodeProxyAnswerRequest(t *testing.T) {
 	})
 }
 
+func TestEncodeTaggedAnswerRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeTaggedAnswerRequest("opaque answer", "test sid", "v1;scheme=test")
+		So(err, ShouldEqual, nil)
+		message, err := DecodeAnswerRequestMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Answer, ShouldEqual, "opaque answer")
+		So(message.Sid, ShouldEqual, "test sid")
+		So(message.Encoding, ShouldEqual, "v1;scheme=test")
+
+		b, err = EncodeAnswerRequest("test answer", "test sid")
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldNotContainSubstring, "Encoding")
+		message, err = DecodeAnswerRequestMessage(b)
+		So(err, ShouldEqual, nil)
+		So(message.Encoding, ShouldEqual, "")
+	})
+}
+
 func TestDecodeProxyAnswerResponse(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
@@ -252,3 +459,112 @@ func TestEncodeProxyAnswerResponse(t *testing.T) {
 		So(err, ShouldEqual, nil)
 	})
 }
+
+func TestDecodeProxyDeregisterRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		for _, test := range []struct {
+			sid  string
+			data string
+			err  error
+		}{
+			{
+				"ymbcCMto7KHNGYlp",
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2"}`,
+				nil,
+			},
+			{
+				"",
+				`{"Version":"1.2"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"2.0"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				"",
+				&json.SyntaxError{},
+			},
+		} {
+			sid, err := DecodeDeregisterRequest([]byte(test.data))
+			So(sid, ShouldResemble, test.sid)
+			So(err, ShouldHaveSameTypeAs, test.err)
+		}
+	})
+}
+
+func TestEncodeProxyDeregisterRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeDeregisterRequest("ymbcCMto7KHNGYlp")
+		So(err, ShouldEqual, nil)
+		sid, err := DecodeDeregisterRequest(b)
+		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(err, ShouldEqual, nil)
+	})
+}
+
+func TestDecodeProxyAckRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		for _, test := range []struct {
+			sid    string
+			status string
+			data   string
+			err    error
+		}{
+			{
+				"ymbcCMto7KHNGYlp",
+				AckSuccess,
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Status":"success"}`,
+				nil,
+			},
+			{
+				"ymbcCMto7KHNGYlp",
+				AckFailure,
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Status":"failure"}`,
+				nil,
+			},
+			{
+				"",
+				"",
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.2","Status":"maybe"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				"",
+				`{"Version":"1.2","Status":"success"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				"",
+				`{"Sid":"ymbcCMto7KHNGYlp","Version":"2.0","Status":"success"}`,
+				fmt.Errorf(""),
+			},
+			{
+				"",
+				"",
+				"",
+				&json.SyntaxError{},
+			},
+		} {
+			sid, status, err := DecodeAckRequest([]byte(test.data))
+			So(sid, ShouldResemble, test.sid)
+			So(status, ShouldResemble, test.status)
+			So(err, ShouldHaveSameTypeAs, test.err)
+		}
+	})
+}
+
+func TestEncodeProxyAckRequest(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodeAckRequest("ymbcCMto7KHNGYlp", AckFailure)
+		So(err, ShouldEqual, nil)
+		sid, status, err := DecodeAckRequest(b)
+		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
+		So(status, ShouldEqual, AckFailure)
+		So(err, ShouldEqual, nil)
+	})
+}
@@ -210,7 +210,9 @@ func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
 	return limitedRead(resp.Body, readLimit)
 }
 
-func (s *SignalingServer) pollOffer(sid string) *webrtc.SessionDescription {
+// Polls the broker until it returns a client offer, which is nil if the
+// response was bad, along with the URLs of any ICE servers the broker suggests.
+func (s *SignalingServer) pollOffer(sid string) (*webrtc.SessionDescription, []string) {
 	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy"})
 	timeOfNextPoll := time.Now()
 	for {
@@ -228,26 +230,26 @@ func (s *SignalingServer) pollOffer(sid string) *webrtc.SessionDescription {
 		body, err := messages.EncodePollRequest(sid, "standalone", currentNATType)
 		if err != nil {
 			log.Printf("Error encoding poll message: %s", err.Error())
-			return nil
+			return nil, nil
 		}
 		resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
 		if err != nil {
 			log.Printf("error polling broker: %s", err.Error())
 		}
 
-		offer, _, err := messages.DecodePollResponse(resp)
+		message, err := messages.DecodePollResponseMessage(resp)
 		if err != nil {
 			log.Printf("Error reading broker response: %s", err.Error())
 			log.Printf("body: %s", resp)
-			return nil
+			return nil, nil
 		}
-		if offer != "" {
-			offer, err := util.DeserializeSessionDescription(offer)
+		if message.Offer != "" {
+			offer, err := util.DeserializeSessionDescription(message.Offer)
 			if err != nil {
 				log.Printf("Error processing session description: %s", err.Error())
-				return nil
+				return nil, nil
 			}
-			return offer
+			return offer, message.ICEServers
 
 		}
 	}
@@ -286,6 +288,25 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 	return nil
 }
 
+// Reports to the broker whether the connection with the client whose offer was
+// answered as sid succeeded. Brokers that do not take acknowledgements reject
+// them, which is harmless.
+func (s *SignalingServer) sendAck(sid string, connected bool) {
+	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy/ack"})
+	status := messages.AckFailure
+	if connected {
+		status = messages.AckSuccess
+	}
+	body, err := messages.EncodeAckRequest(sid, status)
+	if err != nil {
+		log.Printf("Error encoding ack message: %s", err.Error())
+		return
+	}
+	if _, err := s.Post(brokerPath.String(), bytes.NewBuffer(body)); err != nil {
+		log.Printf("error sending ack to broker: %s", err.Error())
+	}
+}
+
 func CopyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) {
 	var wg sync.WaitGroup
 	copyer := func(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
@@ -476,12 +497,19 @@ func makeNewPeerConnection(config webrtc.Configuration,
 }
 
 func (p *SnowflakeProxy) runSession(sid string, config webrtc.Configuration) {
-	offer := p.broker.pollOffer(sid)
+	offer, iceServers := p.broker.pollOffer(sid)
 	if offer == nil {
 		log.Printf("bad offer from broker")
 		p.retToken()
 		return
 	}
+	// Use the ICE servers the broker suggests as well as our own, copying
+	// the list since sessions share config.
+	if len(iceServers) > 0 {
+		servers := make([]webrtc.ICEServer, 0, len(config.ICEServers)+1)
+		servers = append(servers, config.ICEServers...)
+		config.ICEServers = append(servers, webrtc.ICEServer{URLs: iceServers})
+	}
 	dataChan := make(chan struct{})
 	pc, err := makePeerConnectionFromOffer(offer, config, dataChan, p.datachannelHandler)
 	if err != nil {
@@ -504,11 +532,13 @@ func (p *SnowflakeProxy) runSession(sid string, config webrtc.Configuration) {
 	select {
 	case <-dataChan:
 		log.Println("Connection successful.")
+		p.broker.sendAck(sid, true)
 	case <-time.After(dataChannelTimeout):
 		log.Println("Timed out waiting for client to open data channel.")
 		if err := pc.Close(); err != nil {
 			log.Printf("error calling pc.Close: %v", err)
 		}
+		p.broker.sendAck(sid, false)
 		p.retToken()
 	}
 }